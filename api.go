@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+type errorType string
+
+const (
+	errorBadData  errorType = "bad_data"
+	errorExec     errorType = "execution"
+	errorNotFound errorType = "not_found"
+)
+
+type apiError struct {
+	typ errorType
+	err error
+}
+
+func (e *apiError) Error() string {
+	return string(e.typ) + ": " + e.err.Error()
+}
+
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType errorType   `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// API serves the label names, label values, series and postings of an index
+// over HTTP, in the response format of the Prometheus HTTP API.
+type API struct {
+	r *Reader
+}
+
+// NewAPI returns an API over the index read by r.
+func NewAPI(r *Reader) *API {
+	return &API{r: r}
+}
+
+// Register registers the API endpoints under /api/v1 with mux.
+func (api *API) Register(mux *http.ServeMux) {
+	wrap := func(f func(r *http.Request) (interface{}, *apiError)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			data, err := f(r)
+			if err != nil {
+				respondError(w, err)
+				return
+			}
+			respond(w, data)
+		}
+	}
+	mux.Handle("/api/v1/labels", wrap(api.labelNames))
+	mux.Handle("/api/v1/label/", wrap(api.labelValues))
+	mux.Handle("/api/v1/series", wrap(api.series))
+	mux.Handle("/api/v1/postings", wrap(api.postings))
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	b, err := json.Marshal(&response{Status: "success", Data: data})
+	if err != nil {
+		respondError(w, &apiError{errorExec, errors.Wrap(err, "marshal response")})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func respondError(w http.ResponseWriter, apiErr *apiError) {
+	b, err := json.Marshal(&response{
+		Status:    "error",
+		ErrorType: apiErr.typ,
+		Error:     apiErr.err.Error(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	code := http.StatusInternalServerError
+	switch apiErr.typ {
+	case errorBadData:
+		code = http.StatusBadRequest
+	case errorNotFound:
+		code = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func (api *API) labelNames(r *http.Request) (interface{}, *apiError) {
+	names, err := api.r.LabelNames()
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	if names == nil {
+		names = []string{}
+	}
+	return names, nil
+}
+
+// labelValues serves /api/v1/label/<name>/values.
+func (api *API) labelValues(r *http.Request) (interface{}, *apiError) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/label/")
+	if !strings.HasSuffix(name, "/values") {
+		return nil, &apiError{errorNotFound, errors.Errorf("unknown path %q", r.URL.Path)}
+	}
+	name = strings.TrimSuffix(name, "/values")
+	if !labelNameValid(name) {
+		return nil, &apiError{errorBadData, errors.Errorf("invalid label name: %q", name)}
+	}
+
+	values, err := api.r.SortedLabelValues(name)
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	if values == nil {
+		values = []string{}
+	}
+	return values, nil
+}
+
+func labelNameValid(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i, b := range name {
+		if !((b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || (b >= '0' && b <= '9' && i > 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// series serves /api/v1/series, returning the label sets of the series that
+// match any of the match[] selectors and have chunks between start and end.
+func (api *API) series(r *http.Request) (interface{}, *apiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, &apiError{errorBadData, errors.Wrap(err, "error parsing form values")}
+	}
+	if len(r.Form["match[]"]) == 0 {
+		return nil, &apiError{errorBadData, errors.New("no match[] parameter provided")}
+	}
+	start, err := parseTimeParam(r, "start", math.MinInt64)
+	if err != nil {
+		return nil, &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'start'")}
+	}
+	end, err := parseTimeParam(r, "end", math.MaxInt64)
+	if err != nil {
+		return nil, &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'end'")}
+	}
+
+	its := make([]Postings, 0, len(r.Form["match[]"]))
+	for _, s := range r.Form["match[]"] {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return nil, &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'match[]'")}
+		}
+		p, err := PostingsForMatchers(api.r, ms...)
+		if err != nil {
+			return nil, &apiError{errorExec, err}
+		}
+		its = append(its, p)
+	}
+	p := api.r.SortedPostings(MergeContext(r.Context(), its...))
+
+	series, err := api.r.NewSeriesBatch().SeriesForFunc(p, func(_ labels.Labels, chks []chunks.Meta) bool {
+		return overlaps(chks, start, end)
+	})
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	metrics := make([]labels.Labels, 0, len(series))
+	for _, s := range series {
+		metrics = append(metrics, s.Labels)
+	}
+	return metrics, nil
+}
+
+// overlaps returns whether any of the chunks has samples between mint and
+// maxt. Series without chunks only match the unbounded time range.
+func overlaps(chks []chunks.Meta, mint, maxt int64) bool {
+	if len(chks) == 0 {
+		return mint == math.MinInt64 && maxt == math.MaxInt64
+	}
+	for _, c := range chks {
+		if c.OverlapsClosedInterval(mint, maxt) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTimeParam parses a Unix timestamp in seconds or an RFC3339 time into
+// milliseconds.
+func parseTimeParam(r *http.Request, paramName string, defaultValue int64) (int64, error) {
+	val := r.FormValue(paramName)
+	if val == "" {
+		return defaultValue, nil
+	}
+	if t, err := strconv.ParseFloat(val, 64); err == nil {
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UnixNano() / int64(time.Millisecond), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	return 0, errors.Errorf("cannot parse %q to a valid timestamp", val)
+}
+
+// postingsData is the response of /api/v1/postings.
+type postingsData struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Codec string `json:"codec"`
+	// Encoded is the postings list as stored in the index, without its
+	// length and checksum.
+	Encoded  []byte              `json:"encoded"`
+	Postings []storage.SeriesRef `json:"postings"`
+}
+
+// postings serves /api/v1/postings, returning the postings list of the label
+// pair given by the name and value parameters.
+func (api *API) postings(r *http.Request) (interface{}, *apiError) {
+	name, value := r.FormValue("name"), r.FormValue("value")
+	data := &postingsData{
+		Name:     name,
+		Value:    value,
+		Codec:    api.r.dec.Codec.Name(),
+		Postings: []storage.SeriesRef{},
+	}
+
+	found := false
+	if err := api.r.postingsLists(name, []string{value}, func(_ string, b []byte) error {
+		found = true
+		data.Encoded = b
+		_, p, err := api.r.dec.Postings(b)
+		if err != nil {
+			return errors.Wrap(err, "decode postings")
+		}
+		for p.Next() {
+			data.Postings = append(data.Postings, p.At())
+		}
+		return p.Err()
+	}); err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+	if !found {
+		return nil, &apiError{errorNotFound, errors.Errorf("no postings for %s=%q", name, value)}
+	}
+	return data, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+// apiGet requests path from the API server and decodes the data of the
+// response into data.
+func apiGet(t *testing.T, srv *httptest.Server, path string, params url.Values, code int, data interface{}) {
+	resp, err := http.Get(srv.URL + path + "?" + params.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, code, resp.StatusCode)
+
+	var res struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	if code != http.StatusOK {
+		require.Equal(t, "error", res.Status)
+		return
+	}
+	require.Equal(t, "success", res.Status)
+	require.NoError(t, json.Unmarshal(res.Data, data))
+}
+
+func TestAPI(t *testing.T) {
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: roaringBitmapIndexPath, codec: RoaringPostingsCodec},
+	} {
+		t.Run(c.codec.Name(), func(t *testing.T) {
+			ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+			require.NoError(t, err)
+			defer ir.Close()
+
+			mux := http.NewServeMux()
+			NewAPI(ir).Register(mux)
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			expNames, err := ir.LabelNames()
+			require.NoError(t, err)
+			var names []string
+			apiGet(t, srv, "/api/v1/labels", nil, http.StatusOK, &names)
+			require.Equal(t, expNames, names)
+
+			var values []string
+			apiGet(t, srv, "/api/v1/label/job/values", nil, http.StatusOK, &values)
+			require.Equal(t, []string{"demo", "prometheus", "promscale", "robust"}, values)
+			apiGet(t, srv, "/api/v1/label/0job/values", nil, http.StatusBadRequest, nil)
+
+			var series []labels.Labels
+			selector := `go_goroutines{job="prometheus"}`
+			apiGet(t, srv, "/api/v1/series", url.Values{"match[]": {selector, selector}}, http.StatusOK, &series)
+			require.Equal(t, []labels.Labels{
+				labels.FromStrings("__name__", "go_goroutines", "instance", "localhost:9090", "job", "prometheus"),
+			}, series)
+
+			apiGet(t, srv, "/api/v1/series", url.Values{"match[]": {`{job="demo"}`, `{__name__="up"}`}}, http.StatusOK, &series)
+			for i, lset := range series {
+				require.True(t, lset.Get("job") == "demo" || lset.Get("__name__") == "up", "unexpected series %s", lset)
+				if i > 0 {
+					require.Less(t, labels.Compare(series[i-1], lset), 0)
+				}
+			}
+			apiGet(t, srv, "/api/v1/series", url.Values{"match[]": {selector}, "start": {"4102444800"}}, http.StatusOK, &series)
+			require.Empty(t, series)
+			apiGet(t, srv, "/api/v1/series", url.Values{"match[]": {"{"}}, http.StatusBadRequest, nil)
+			apiGet(t, srv, "/api/v1/series", nil, http.StatusBadRequest, nil)
+
+			var postings postingsData
+			apiGet(t, srv, "/api/v1/postings", url.Values{"name": {"job"}, "value": {"demo"}}, http.StatusOK, &postings)
+			require.Equal(t, c.codec.Name(), postings.Codec)
+			p, err := ir.Postings("job", "demo")
+			require.NoError(t, err)
+			exp, err := ExpandPostings(p)
+			require.NoError(t, err)
+			require.Equal(t, exp, postings.Postings)
+			_, p, err = c.codec.DecodePostings(postings.Encoded)
+			require.NoError(t, err)
+			got, err := ExpandPostings(p)
+			require.NoError(t, err)
+			require.Equal(t, exp, got)
+
+			apiGet(t, srv, "/api/v1/postings", url.Values{"name": {"job"}, "value": {"missing"}}, http.StatusNotFound, nil)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// selectSeries returns the label sets of the series of ix matching ms, in
+// label order.
+func selectSeries(ix *Reader, ms []*labels.Matcher) ([]labels.Labels, error) {
+	p, err := PostingsForMatchers(ix, ms...)
+	if err != nil {
+		return nil, err
+	}
+	p = ix.SortedPostings(p)
+
+	var (
+		res  []labels.Labels
+		chks []chunks.Meta
+	)
+	for p.Next() {
+		var lset labels.Labels
+		if err := ix.Series(p.At(), &lset, &chks); err != nil {
+			return nil, err
+		}
+		res = append(res, lset)
+	}
+	return res, p.Err()
+}
+
+// CompareWorkload selects the series of every query of the workload from each
+// index, runs times, and writes the median latency per index to w. It fails
+// if the indexes disagree on the matching series, or if a query does not
+// match its expected cardinality.
+func CompareWorkload(w io.Writer, queries []WorkloadQuery, names []string, readers []*Reader, runs int) error {
+	if runs < 1 {
+		return errors.Errorf("invalid number of runs %d", runs)
+	}
+	if _, err := fmt.Fprintf(w, "%-60s %8s", "selector", "series"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, " %16s", name); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for _, q := range queries {
+		var (
+			exp       []labels.Labels
+			latencies = make([]time.Duration, len(readers))
+		)
+		for i, r := range readers {
+			durations := make([]time.Duration, 0, runs)
+			var series []labels.Labels
+			for j := 0; j < runs; j++ {
+				start := time.Now()
+				s, err := selectSeries(r, q.Matchers)
+				if err != nil {
+					return errors.Wrapf(err, "select %s from %s", q.Selector, names[i])
+				}
+				durations = append(durations, time.Since(start))
+				series = s
+			}
+			sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+			latencies[i] = durations[len(durations)/2]
+
+			if i == 0 {
+				exp = series
+			} else if !equalLabelSets(exp, series) {
+				mismatches = append(mismatches, fmt.Sprintf("%s: %s returned %d series, %s returned %d different ones", q.Selector, names[0], len(exp), names[i], len(series)))
+			}
+		}
+		if q.ExpectedCardinality >= 0 && q.ExpectedCardinality != len(exp) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %d series, got %d", q.Selector, q.ExpectedCardinality, len(exp)))
+		}
+
+		if _, err := fmt.Fprintf(w, "%-60s %8d", q.Selector, len(exp)); err != nil {
+			return err
+		}
+		for _, l := range latencies {
+			if _, err := fmt.Fprintf(w, " %16s", l); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	if len(mismatches) > 0 {
+		return errors.Errorf("%d mismatches: %v", len(mismatches), mismatches)
+	}
+	return nil
+}
+
+func equalLabelSets(a, b []labels.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if labels.Compare(a[i], b[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+
+	h_labels "github.com/Harkishen-Singh/prometheus/model/labels"
+	h_storage "github.com/Harkishen-Singh/prometheus/storage"
+	rb_tsdb "github.com/Harkishen-Singh/prometheus/tsdb"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	be_tsdb "github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// Blocks written by the fixtures command from the series of
+// bigEndianIndexPath, by upstream Prometheus and by the fork storing postings
+// as roaring bitmaps. They are not checked in.
+const (
+	bigEndianBlockPath     = "data/fixtures/big_endian"
+	roaringBitmapBlockPath = "data/fixtures/roaring_bitmap"
+)
+
+// FixtureOptions configures the samples generated for the fixture blocks.
+type FixtureOptions struct {
+	// MinTime and MaxTime are the timestamps of the first and last sample
+	// of every series, in milliseconds.
+	MinTime, MaxTime int64
+	// Samples is the number of samples of every series.
+	Samples int
+}
+
+// DefaultFixtureOptions spread 120 samples per series over the six hours of
+// the block the indexes in data/ were taken from.
+var DefaultFixtureOptions = FixtureOptions{
+	MinTime: 1641924000000,
+	MaxTime: 1641945599999,
+	Samples: 120,
+}
+
+// fixtureCommitSeries is the number of series appended between commits.
+const fixtureCommitSeries = 1000
+
+// BuildFixtureBlocks writes all series of r with generated samples to a block
+// at beDir, written by upstream Prometheus, and to its twin at rbDir, written
+// by the fork. The samples of a series only depend on its labels and opts, so
+// that the blocks are the same on every run but for their ULIDs. Existing
+// blocks at beDir and rbDir are replaced.
+func BuildFixtureBlocks(ctx context.Context, logger log.Logger, r *Reader, beDir, rbDir string, opts FixtureOptions) error {
+	if opts.Samples < 1 || opts.MaxTime < opts.MinTime {
+		return errors.Errorf("invalid fixture options %+v", opts)
+	}
+	for _, dir := range []string{beDir, rbDir} {
+		if err := os.RemoveAll(dir + ".tmp"); err != nil {
+			return err
+		}
+	}
+	// Blocks are flushed into a directory named after their ULID, which is
+	// moved to its final path afterwards. The head rejects samples older
+	// than half the block size before its latest one, so the block size is
+	// twice the time range of the samples.
+	blockSize := 2 * (opts.MaxTime - opts.MinTime + 1)
+	beWriter, err := be_tsdb.NewBlockWriter(logger, beDir+".tmp", blockSize)
+	if err != nil {
+		return errors.Wrap(err, "create big endian block writer")
+	}
+	defer beWriter.Close()
+	rbWriter, err := rb_tsdb.NewBlockWriter(logger, rbDir+".tmp", blockSize)
+	if err != nil {
+		return errors.Wrap(err, "create roaring bitmap block writer")
+	}
+	defer rbWriter.Close()
+
+	p, err := r.Postings(AllPostingsKey())
+	if err != nil {
+		return errors.Wrap(err, "get all postings")
+	}
+	var (
+		beApp = beWriter.Appender(ctx)
+		rbApp = rbWriter.Appender(ctx)
+		chks  []chunks.Meta
+		n     int
+	)
+	for p.Next() {
+		// The head keeps the labels of new series, so they are not reused.
+		var lset labels.Labels
+		if err := r.Series(p.At(), &lset, &chks); err != nil {
+			return errors.Wrapf(err, "read series %d", p.At())
+		}
+		if err := appendFixtureSeries(beApp, rbApp, lset, opts); err != nil {
+			return errors.Wrapf(err, "append series %s", lset)
+		}
+		if n++; n%fixtureCommitSeries == 0 {
+			if err := commitFixtureAppenders(beApp, rbApp); err != nil {
+				return err
+			}
+			beApp, rbApp = beWriter.Appender(ctx), rbWriter.Appender(ctx)
+		}
+	}
+	if err := p.Err(); err != nil {
+		return errors.Wrap(err, "iterate all postings")
+	}
+	if err := commitFixtureAppenders(beApp, rbApp); err != nil {
+		return err
+	}
+
+	beID, err := beWriter.Flush(ctx)
+	if err != nil {
+		return errors.Wrap(err, "flush big endian block")
+	}
+	rbID, err := rbWriter.Flush(ctx)
+	if err != nil {
+		return errors.Wrap(err, "flush roaring bitmap block")
+	}
+	if err := moveBlock(filepath.Join(beDir+".tmp", beID.String()), beDir); err != nil {
+		return err
+	}
+	return moveBlock(filepath.Join(rbDir+".tmp", rbID.String()), rbDir)
+}
+
+// appendFixtureSeries appends the generated samples of the series with the
+// labels lset to both appenders.
+func appendFixtureSeries(beApp storage.Appender, rbApp h_storage.Appender, lset labels.Labels, opts FixtureOptions) error {
+	forkLset := make(h_labels.Labels, 0, len(lset))
+	for _, l := range lset {
+		forkLset = append(forkLset, h_labels.Label{Name: l.Name, Value: l.Value})
+	}
+
+	var (
+		rnd     = rand.New(rand.NewSource(int64(lset.Hash())))
+		v       = float64(rnd.Intn(1000))
+		beRef   storage.SeriesRef
+		rbRef   h_storage.SeriesRef
+		err     error
+		samples = int64(opts.Samples)
+	)
+	for i := int64(0); i < samples; i++ {
+		t := opts.MinTime
+		if samples > 1 {
+			t += i * (opts.MaxTime - opts.MinTime) / (samples - 1)
+		}
+		// Mostly increasing values, like the counters most series are.
+		v += float64(rnd.Intn(100))
+		if beRef, err = beApp.Append(beRef, lset, t, v); err != nil {
+			return err
+		}
+		if rbRef, err = rbApp.Append(rbRef, forkLset, t, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func commitFixtureAppenders(beApp storage.Appender, rbApp h_storage.Appender) error {
+	if err := beApp.Commit(); err != nil {
+		return errors.Wrap(err, "commit big endian samples")
+	}
+	if err := rbApp.Commit(); err != nil {
+		return errors.Wrap(err, "commit roaring bitmap samples")
+	}
+	return nil
+}
+
+// moveBlock replaces the block at dst with the one at src, and removes the
+// directory src was flushed into.
+func moveBlock(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o777); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return errors.Wrapf(err, "move block %s", src)
+	}
+	return os.RemoveAll(filepath.Dir(src))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	h_labels "github.com/Harkishen-Singh/prometheus/model/labels"
+	h_storage "github.com/Harkishen-Singh/prometheus/storage"
+	rb_tsdb "github.com/Harkishen-Singh/prometheus/tsdb"
+	rb_chunkenc "github.com/Harkishen-Singh/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/model/labels"
+	p_storage "github.com/prometheus/prometheus/storage"
+	be_tsdb "github.com/prometheus/prometheus/tsdb"
+	be_chunkenc "github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// openFixtureQueriers returns queriers over all samples of the blocks at beDir
+// and rbDir, and skips tb if they have not been built.
+func openFixtureQueriers(tb testing.TB, beDir, rbDir string) (p_storage.Querier, h_storage.Querier) {
+	for _, dir := range []string{beDir, rbDir} {
+		if _, err := os.Stat(filepath.Join(dir, "meta.json")); os.IsNotExist(err) {
+			tb.Skipf("fixture block %s not found, build it with 'go run . fixtures'", dir)
+		}
+	}
+	logger := log.NewNopLogger()
+
+	beBlock, err := be_tsdb.OpenBlock(logger, beDir, be_chunkenc.NewPool())
+	require.NoError(tb, err)
+	tb.Cleanup(func() { require.NoError(tb, beBlock.Close()) })
+	beQuerier, err := be_tsdb.NewBlockQuerier(beBlock, beBlock.MinTime(), beBlock.MaxTime())
+	require.NoError(tb, err)
+	tb.Cleanup(func() { require.NoError(tb, beQuerier.Close()) })
+
+	rbBlock, err := rb_tsdb.OpenBlock(logger, rbDir, rb_chunkenc.NewPool())
+	require.NoError(tb, err)
+	tb.Cleanup(func() { require.NoError(tb, rbBlock.Close()) })
+	rbQuerier, err := rb_tsdb.NewBlockQuerier(rbBlock, rbBlock.MinTime(), rbBlock.MaxTime())
+	require.NoError(tb, err)
+	tb.Cleanup(func() { require.NoError(tb, rbQuerier.Close()) })
+
+	return beQuerier, rbQuerier
+}
+
+func TestBuildFixtureBlocks(t *testing.T) {
+	series := generateIndexSeries(1, 500)
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index")
+	writeIndex(t, indexPath, BigEndianPostingsCodec, indexSymbols(series), series)
+	r, err := NewFileReader(indexPath)
+	require.NoError(t, err)
+	defer r.Close()
+
+	opts := FixtureOptions{MinTime: 1000, MaxTime: 60000, Samples: 10}
+	build := func(name string) (string, string) {
+		beDir, rbDir := filepath.Join(dir, name, "big_endian"), filepath.Join(dir, name, "roaring_bitmap")
+		require.NoError(t, BuildFixtureBlocks(context.Background(), log.NewNopLogger(), r, beDir, rbDir, opts))
+		return beDir, rbDir
+	}
+	beDir, rbDir := build("first")
+
+	// Rebuilding writes the same index and chunks, and replaces the blocks.
+	otherBEDir, otherRBDir := build("second")
+	build("second")
+	for _, dirs := range [][2]string{{beDir, otherBEDir}, {rbDir, otherRBDir}} {
+		for _, file := range []string{"index", filepath.Join("chunks", "000001")} {
+			exp, err := ioutil.ReadFile(filepath.Join(dirs[0], file))
+			require.NoError(t, err)
+			got, err := ioutil.ReadFile(filepath.Join(dirs[1], file))
+			require.NoError(t, err)
+			require.Equal(t, exp, got, "%s of %s", file, dirs[1])
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "second"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// The roaring bitmap block holds the series of the index.
+	rb, err := NewFileReaderWithOptions(filepath.Join(rbDir, "index"), ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+	require.NoError(t, err)
+	defer rb.Close()
+	got := readIndexSeries(t, rb)
+	require.Len(t, got, len(series))
+	for i := range series {
+		require.Equal(t, series[i].lset, got[i].lset)
+	}
+
+	beQuerier, rbQuerier := openFixtureQueriers(t, beDir, rbDir)
+	for _, m := range [][2]string{
+		{labels.MetricName, ".+"},
+		{labels.MetricName, "metric_1"},
+		{"instance", "host-00.*"},
+		{"le", "0|1"},
+	} {
+		beSet := beQuerier.Select(true, nil, labels.MustNewMatcher(labels.MatchRegexp, m[0], m[1]))
+		rbSet := rbQuerier.Select(true, nil, h_labels.MustNewMatcher(h_labels.MatchRegexp, m[0], m[1]))
+		require.NotZero(t, compareSeriesSet(t, beSet, rbSet), "%s=~%q", m[0], m[1])
+	}
+
+	// Every series has all samples in the time range of the options.
+	set := beQuerier.Select(false, nil, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	n := 0
+	for set.Next() {
+		n++
+		var ts []int64
+		it := set.At().Iterator()
+		for it.Next() {
+			t, _ := it.At()
+			ts = append(ts, t)
+		}
+		require.NoError(t, it.Err())
+		require.Len(t, ts, opts.Samples)
+		require.Equal(t, opts.MinTime, ts[0])
+		require.Equal(t, opts.MaxTime, ts[len(ts)-1])
+	}
+	require.NoError(t, set.Err())
+	require.Equal(t, len(series), n)
+}
+
+func TestOpenFixtureQueriersSkips(t *testing.T) {
+	dir := t.TempDir()
+	var skipped bool
+	t.Run("missing", func(t *testing.T) {
+		defer func() { skipped = t.Skipped() }()
+		openFixtureQueriers(t, filepath.Join(dir, "big_endian"), filepath.Join(dir, "roaring_bitmap"))
+	})
+	require.True(t, skipped)
+}
@@ -1,6 +1,6 @@
 module github.com/Harkishen-Singh/prom-posting-comparison
 
-go 1.17
+go 1.18
 
 require (
 	github.com/Harkishen-Singh/prometheus v1.8.2-0.20220201140204-e4e17abf97f5
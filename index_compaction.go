@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+)
+
+// ChunkRefMapper returns the reference that the chunk chk of a series of the
+// reader at index i of the merged readers has in the chunks of the merged
+// block.
+type ChunkRefMapper func(i int, chk chunks.Meta) (chunks.ChunkRef, error)
+
+// SameBlockChunkRefs is a ChunkRefMapper keeping chunk references unchanged,
+// for indexes whose series all refer to the chunks of the same block.
+func SameBlockChunkRefs(_ int, chk chunks.Meta) (chunks.ChunkRef, error) {
+	return chk.Ref, nil
+}
+
+// CompactIndexes merges the given indexes into a new index at fn, whose
+// postings are written with codec regardless of the codecs of the inputs.
+// See MergeIndexes for chunk references and the returned series reference
+// mapping.
+func CompactIndexes(ctx context.Context, fn string, codec PostingsCodec, mapChunkRef ChunkRefMapper, readers ...*Reader) ([]map[storage.SeriesRef]storage.SeriesRef, error) {
+	w, err := NewWriterWithCodec(ctx, fn, codec)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := MergeIndexes(w, mapChunkRef, readers...)
+	if err != nil {
+		return nil, tsdb_errors.NewMulti(err, w.Close()).Err()
+	}
+	return refs, w.Close()
+}
+
+// MergeIndexes adds the symbols and series of all readers to w, which must not
+// have been written to yet. Series with identical label sets are merged into
+// one, with their chunks ordered by time.
+//
+// Chunk references are only valid within the chunks directory of the block
+// they come from, so references of different blocks may collide. They are
+// rewritten with mapChunkRef, which is required when merging more than one
+// index; a nil mapChunkRef keeps the references of a single index unchanged.
+//
+// The Writer builds the postings lists from the series it is given, so the
+// postings of identical label pairs are the union of their input postings,
+// remapped to the new series references. The mapping from old to new series
+// references is returned for each reader.
+func MergeIndexes(w *Writer, mapChunkRef ChunkRefMapper, readers ...*Reader) ([]map[storage.SeriesRef]storage.SeriesRef, error) {
+	if mapChunkRef == nil {
+		if len(readers) > 1 {
+			return nil, errors.Errorf("chunk references of %d indexes can't be merged without a chunk reference mapping", len(readers))
+		}
+		mapChunkRef = SameBlockChunkRefs
+	}
+
+	var symbols StringIter = NewStringListIter(nil)
+	for _, r := range readers {
+		symbols = NewMergedStringIter(symbols, r.Symbols())
+	}
+	for symbols.Next() {
+		if err := w.AddSymbol(symbols.At()); err != nil {
+			return nil, errors.Wrap(err, "add symbol")
+		}
+	}
+	if err := symbols.Err(); err != nil {
+		return nil, errors.Wrap(err, "merge symbols")
+	}
+
+	refs := make([]map[storage.SeriesRef]storage.SeriesRef, len(readers))
+	h := make(seriesCursorHeap, 0, len(readers))
+	for i, r := range readers {
+		refs[i] = map[storage.SeriesRef]storage.SeriesRef{}
+		p, err := r.Postings(AllPostingsKey())
+		if err != nil {
+			return nil, errors.Wrap(err, "get all postings")
+		}
+		c := &seriesCursor{r: r, idx: i, p: p}
+		ok, err := c.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			h = append(h, c)
+		}
+	}
+	heap.Init(&h)
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+		from []*seriesCursor
+		ref  storage.SeriesRef
+	)
+	for h.Len() > 0 {
+		// Gather the cursors of all readers holding the next label set.
+		lset = append(lset[:0], h[0].lset...)
+		chks, from = chks[:0], from[:0]
+		for h.Len() > 0 && labels.Compare(h[0].lset, lset) == 0 {
+			c := heap.Pop(&h).(*seriesCursor)
+			for _, chk := range c.chks {
+				chkRef, err := mapChunkRef(c.idx, chk)
+				if err != nil {
+					return nil, errors.Wrapf(err, "map chunk %d of series %s", chk.Ref, lset)
+				}
+				chk.Ref = chkRef
+				chks = append(chks, chk)
+			}
+			from = append(from, c)
+		}
+		sort.SliceStable(chks, func(i, j int) bool { return chks[i].MinTime < chks[j].MinTime })
+
+		if err := w.AddSeries(ref, lset, chks...); err != nil {
+			return nil, errors.Wrapf(err, "add series %s", lset)
+		}
+		ref++
+
+		for _, c := range from {
+			refs[c.idx][c.p.At()] = w.lastWrittenRef
+			ok, err := c.next()
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				heap.Push(&h, c)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// seriesCursor walks the series of a Reader in the order of their label sets.
+type seriesCursor struct {
+	r   *Reader
+	idx int
+	p   Postings
+
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+func (c *seriesCursor) next() (bool, error) {
+	if !c.p.Next() {
+		return false, errors.Wrap(c.p.Err(), "iterate all postings")
+	}
+	if err := c.r.Series(c.p.At(), &c.lset, &c.chks); err != nil {
+		return false, errors.Wrapf(err, "read series %d", c.p.At())
+	}
+	return true, nil
+}
+
+type seriesCursorHeap []*seriesCursor
+
+func (h seriesCursorHeap) Len() int { return len(h) }
+func (h seriesCursorHeap) Less(i, j int) bool {
+	if c := labels.Compare(h[i].lset, h[j].lset); c != 0 {
+		return c < 0
+	}
+	// Keep the inputs of identical series in reader order.
+	return h[i].idx < h[j].idx
+}
+func (h *seriesCursorHeap) Swap(i, j int) { (*h)[i], (*h)[j] = (*h)[j], (*h)[i] }
+
+func (h *seriesCursorHeap) Push(x interface{}) {
+	*h = append(*h, x.(*seriesCursor))
+}
+
+func (h *seriesCursorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/stretchr/testify/require"
+)
+
+// splitIndex writes the series of the index at src to two indexes in dir,
+// with the given codecs. Some series end up in both, each with part of their
+// chunks, so that merging the two yields the original index again.
+func splitIndex(tb testing.TB, src, dir string, codecs [2]PostingsCodec) [2]string {
+	r, err := NewFileReader(src)
+	require.NoError(tb, err)
+	defer r.Close()
+
+	var parts [2][]indexSeries
+	for i, s := range readIndexSeries(tb, r) {
+		switch {
+		case i%3 == 2 && len(s.chks) > 1:
+			half := len(s.chks) / 2
+			parts[0] = append(parts[0], indexSeries{lset: s.lset, chks: s.chks[:half]})
+			parts[1] = append(parts[1], indexSeries{lset: s.lset, chks: s.chks[half:]})
+		case i%3 == 1:
+			parts[1] = append(parts[1], s)
+		default:
+			parts[0] = append(parts[0], s)
+		}
+	}
+
+	var paths [2]string
+	symbols := readSymbols(tb, r)
+	for i := range parts {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("part%d_%s", i, codecs[i].Name()))
+		writeIndex(tb, paths[i], codecs[i], symbols, parts[i])
+	}
+	return paths
+}
+
+func TestCompactIndexes(t *testing.T) {
+	exp, err := ioutil.ReadFile(bigEndianIndexPath)
+	require.NoError(t, err)
+
+	for _, inputs := range [][2]PostingsCodec{
+		{BigEndianPostingsCodec, BigEndianPostingsCodec},
+		{BigEndianPostingsCodec, RoaringPostingsCodec},
+		{RoaringPostingsCodec, RoaringPostingsCodec},
+	} {
+		for _, output := range []PostingsCodec{BigEndianPostingsCodec, RoaringPostingsCodec} {
+			t.Run(fmt.Sprintf("%s+%s=%s", inputs[0].Name(), inputs[1].Name(), output.Name()), func(t *testing.T) {
+				dir := t.TempDir()
+				paths := splitIndex(t, bigEndianIndexPath, dir, inputs)
+				readers := make([]*Reader, len(paths))
+				for i, path := range paths {
+					r, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: inputs[i]})
+					require.NoError(t, err)
+					defer r.Close()
+					readers[i] = r
+				}
+
+				path := filepath.Join(dir, "compacted")
+				refs, err := CompactIndexes(context.Background(), path, output, SameBlockChunkRefs, readers...)
+				require.NoError(t, err)
+				if output == BigEndianPostingsCodec {
+					got, err := ioutil.ReadFile(path)
+					require.NoError(t, err)
+					require.Equal(t, exp, got)
+				}
+
+				compacted, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: output})
+				require.NoError(t, err)
+				defer compacted.Close()
+
+				// The postings of each label pair are the union of the remapped input postings.
+				ranges, err := compacted.PostingsRanges()
+				require.NoError(t, err)
+				for l := range ranges {
+					want := map[storage.SeriesRef]struct{}{}
+					for i, r := range readers {
+						p, err := r.Postings(l.Name, l.Value)
+						require.NoError(t, err)
+						for p.Next() {
+							want[refs[i][p.At()]] = struct{}{}
+						}
+						require.NoError(t, p.Err())
+					}
+					p, err := compacted.Postings(l.Name, l.Value)
+					require.NoError(t, err)
+					got, err := ExpandPostings(p)
+					require.NoError(t, err)
+					require.Equal(t, len(want), len(got), "postings for %s", l)
+					for _, ref := range got {
+						_, ok := want[ref]
+						require.True(t, ok, "unexpected series %d in postings for %s", ref, l)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCompactIndexesChunkRefs(t *testing.T) {
+	dir := t.TempDir()
+	paths := splitIndex(t, bigEndianIndexPath, dir, [2]PostingsCodec{BigEndianPostingsCodec, BigEndianPostingsCodec})
+	readers := make([]*Reader, len(paths))
+	for i, path := range paths {
+		r, err := NewFileReader(path)
+		require.NoError(t, err)
+		defer r.Close()
+		readers[i] = r
+	}
+
+	// Chunk references of more than one index need to be mapped.
+	_, err := CompactIndexes(context.Background(), filepath.Join(dir, "unmapped"), BigEndianPostingsCodec, nil, readers...)
+	require.Error(t, err)
+
+	// References of each reader are moved to a segment file of their own.
+	mapped := map[chunks.ChunkRef]int{}
+	path := filepath.Join(dir, "mapped")
+	refs, err := CompactIndexes(context.Background(), path, BigEndianPostingsCodec, func(i int, chk chunks.Meta) (chunks.ChunkRef, error) {
+		ref := chunks.ChunkRef(uint64(i+1)<<32 | uint64(chk.Ref)&(1<<32-1))
+		mapped[ref] = i
+		return ref, nil
+	}, readers...)
+	require.NoError(t, err)
+
+	compacted, err := NewFileReader(path)
+	require.NoError(t, err)
+	defer compacted.Close()
+	for i, r := range readers {
+		for ref, newRef := range refs[i] {
+			var (
+				lset labels.Labels
+				chks []chunks.Meta
+			)
+			require.NoError(t, r.Series(ref, &lset, &chks))
+			want := map[chunks.ChunkRef]struct{}{}
+			for _, chk := range chks {
+				want[chunks.ChunkRef(uint64(i+1)<<32|uint64(chk.Ref)&(1<<32-1))] = struct{}{}
+			}
+
+			var got []chunks.Meta
+			require.NoError(t, compacted.Series(newRef, &lset, &got))
+			for _, chk := range got {
+				j, ok := mapped[chk.Ref]
+				require.True(t, ok, "unmapped chunk %d", chk.Ref)
+				if j == i {
+					delete(want, chk.Ref)
+				}
+			}
+			require.Empty(t, want, "chunks of series %d of reader %d", ref, i)
+		}
+	}
+}
+
+func BenchmarkCompactIndexes(b *testing.B) {
+	dir := b.TempDir()
+	for _, codec := range []PostingsCodec{BigEndianPostingsCodec, RoaringPostingsCodec} {
+		paths := splitIndex(b, bigEndianIndexPath, dir, [2]PostingsCodec{codec, codec})
+		readers := make([]*Reader, len(paths))
+		for i, path := range paths {
+			r, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: codec})
+			require.NoError(b, err)
+			defer r.Close()
+			readers[i] = r
+		}
+
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := CompactIndexes(context.Background(), filepath.Join(dir, "compacted"), codec, SameBlockChunkRefs, readers...)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+	tsdb_errors "github.com/prometheus/prometheus/tsdb/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+)
+
+// An index header holds the parts of an index that a Reader keeps in memory,
+// so that a Reader can be opened from it without reading the index, and read
+// the rest of the index lazily, e.g. from object storage. It is laid out as:
+//
+//	┌─────────────────────────────────────────────────┐
+//	│ magic(0xBAAAD701) <4b> │ version(1) <1b>        │
+//	│ index version <1b>                              │
+//	├─────────────────────────────────────────────────┤
+//	│ Symbols, copied from the index                  │
+//	├─────────────────────────────────────────────────┤
+//	│ Postings Offsets                                │
+//	├─────────────────────────────────────────────────┤
+//	│ TOC                                             │
+//	└─────────────────────────────────────────────────┘
+//
+// The postings offsets hold every label name with its symbol, and the sampled
+// entries of the postings offset table of the index with their offsets in the
+// table:
+//
+//	┌────────────────────┬────────────────────┬─────────────────────┐
+//	│ len <4b>           │ factor <uvarint>   │ #names <uvarint>    │
+//	├────────────────────┴────────────────────┴─────────────────────┤
+//	│ ┌───────────────────────────────────────────────────────────┐ │
+//	│ │ name <uvarint str> │ symbol <uvarint> │ #values <uvarint> │ │
+//	│ ├───────────────────────────────────────────────────────────┤ │
+//	│ │ value <uvarint str> │ offset <uvarint>                    │ │
+//	│ │ ...                                                       │ │
+//	│ └───────────────────────────────────────────────────────────┘ │
+//	│ ...                                                           │
+//	├───────────────────────────────────────────────────────────────┤
+//	│ CRC32 <4b>                                                    │
+//	└───────────────────────────────────────────────────────────────┘
+//
+// The TOC holds the offsets of the symbols and postings offsets in the header,
+// the size of the index, the end of the entries of its postings offset table,
+// and the TOC of the index, followed by their CRC32.
+const (
+	// MagicIndexHeader 4 bytes at the head of an index header file.
+	MagicIndexHeader = 0xBAAAD701
+	// IndexHeaderVersion1 is the version of the index header format.
+	IndexHeaderVersion1 = 1
+
+	indexHeaderHeaderLen = 6
+	indexHeaderTOCLen    = 10*8 + crc32.Size
+)
+
+// WriteHeader writes the index header of the index read by r to w. The postings
+// offsets are sampled as by r.
+func (r *Reader) WriteHeader(w io.Writer) error {
+	if r.version != FormatV2 {
+		return errors.Errorf("index headers of format version %d are not supported", r.version)
+	}
+	var buf encoding.Encbuf
+	buf.PutBE32(MagicIndexHeader)
+	buf.PutByte(IndexHeaderVersion1)
+	buf.PutByte(byte(r.version))
+
+	// The symbols table is copied with its length and CRC32.
+	symbolsOff := buf.Len()
+	d := encoding.NewDecbufAt(r.b, int(r.toc.Symbols), castagnoliTable)
+	if d.Err() != nil {
+		return errors.Wrap(d.Err(), "read symbols")
+	}
+	buf.PutBytes(r.b.Range(int(r.toc.Symbols), int(r.toc.Symbols)+4+d.Len()+crc32.Size))
+
+	postingsOff := buf.Len()
+	names := make([]string, 0, len(r.postings))
+	for name := range r.postings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	symbols := make(map[string]uint32, len(r.nameSymbols))
+	for sym, name := range r.nameSymbols {
+		symbols[name] = sym
+	}
+	buf.PutBE32(0) // Length, set below.
+	start := buf.Len()
+	buf.PutUvarint(r.postingsFactor)
+	buf.PutUvarint(len(names))
+	for _, name := range names {
+		buf.PutUvarintStr(name)
+		buf.PutUvarint32(symbols[name])
+		buf.PutUvarint(len(r.postings[name]))
+		for _, e := range r.postings[name] {
+			buf.PutUvarintStr(e.value)
+			buf.PutUvarint(e.off)
+		}
+	}
+	binary.BigEndian.PutUint32(buf.Get()[postingsOff:], uint32(buf.Len()-start))
+	putCRC32(&buf, start)
+
+	tocStart := buf.Len()
+	buf.PutBE64(uint64(symbolsOff))
+	buf.PutBE64(uint64(postingsOff))
+	buf.PutBE64(uint64(r.b.Len()))
+	buf.PutBE64(uint64(r.postingsTableEnd))
+	buf.PutBE64(r.toc.Symbols)
+	buf.PutBE64(r.toc.Series)
+	buf.PutBE64(r.toc.LabelIndices)
+	buf.PutBE64(r.toc.LabelIndicesTable)
+	buf.PutBE64(r.toc.Postings)
+	buf.PutBE64(r.toc.PostingsTable)
+	putCRC32(&buf, tocStart)
+
+	_, err := w.Write(buf.Get())
+	return err
+}
+
+// putCRC32 appends the CRC32 of the bytes of buf from start.
+func putCRC32(buf *encoding.Encbuf, start int) {
+	h := newCRC32()
+	_, _ = h.Write(buf.Get()[start:])
+	buf.PutHashSum(h)
+}
+
+// WriteHeaderFile writes the index header of the index read by r to the file
+// at path.
+func (r *Reader) WriteHeaderFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.WriteHeader(f); err != nil {
+		return tsdb_errors.NewMulti(err, f.Close()).Err()
+	}
+	return f.Close()
+}
+
+// multiCloser closes all of its closers.
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	return tsdb_errors.CloseAll(c)
+}
+
+// NewReaderFromHeader returns a new reader of the index b starting from its
+// index header h, without reading b. Only the parts of b needed by lookups are
+// read from it, so that they can be fetched lazily. The postings offsets are
+// sampled as when the header was written, and opts.PostingsOffsetsFactor is
+// ignored.
+func NewReaderFromHeader(h, b ByteSlice, opts ReaderOptions) (*Reader, error) {
+	return newReaderFromHeader(h, b, ioutil.NopCloser(nil), opts)
+}
+
+// NewFileReaderFromHeader returns a new reader of the index file at indexPath
+// starting from the index header file at headerPath. Both files are mmapped.
+func NewFileReaderFromHeader(headerPath, indexPath string, opts ReaderOptions) (*Reader, error) {
+	hf, err := fileutil.OpenMmapFile(headerPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fileutil.OpenMmapFile(indexPath)
+	if err != nil {
+		return nil, tsdb_errors.NewMulti(err, hf.Close()).Err()
+	}
+	r, err := newReaderFromHeader(realByteSlice(hf.Bytes()), realByteSlice(f.Bytes()), multiCloser{hf, f}, opts)
+	if err != nil {
+		return nil, tsdb_errors.NewMulti(err, hf.Close(), f.Close()).Err()
+	}
+	return r, nil
+}
+
+func newReaderFromHeader(h, b ByteSlice, c io.Closer, opts ReaderOptions) (*Reader, error) {
+	if opts.PostingsCodec == nil {
+		opts.PostingsCodec = BigEndianPostingsCodec
+	}
+	if opts.SymbolsFactor == 0 {
+		opts.SymbolsFactor = DefaultSymbolsFactor
+	}
+
+	if h.Len() < indexHeaderHeaderLen+indexHeaderTOCLen {
+		return nil, errors.Wrap(encoding.ErrInvalidSize, "index header")
+	}
+	if m := binary.BigEndian.Uint32(h.Range(0, 4)); m != MagicIndexHeader {
+		return nil, errors.Errorf("invalid magic number %x", m)
+	}
+	if v := h.Range(4, 5)[0]; v != IndexHeaderVersion1 {
+		return nil, errors.Errorf("unknown index header version %d", v)
+	}
+	r := &Reader{
+		b:       b,
+		c:       c,
+		version: int(h.Range(5, 6)[0]),
+	}
+	if r.version != FormatV2 {
+		return nil, errors.Errorf("unsupported index file version %d", r.version)
+	}
+
+	tocBytes := h.Range(h.Len()-indexHeaderTOCLen, h.Len())
+	d := encoding.Decbuf{B: tocBytes[:len(tocBytes)-crc32.Size]}
+	if d.Crc32(castagnoliTable) != binary.BigEndian.Uint32(tocBytes[len(tocBytes)-crc32.Size:]) {
+		return nil, errors.Wrap(encoding.ErrInvalidChecksum, "read index header TOC")
+	}
+	var (
+		symbolsOff   = d.Be64()
+		postingsOff  = d.Be64()
+		indexSize    = d.Be64()
+		postingsEnd  = d.Be64()
+		sectionLimit = uint64(h.Len() - indexHeaderTOCLen)
+	)
+	r.toc = &TOC{
+		Symbols:           d.Be64(),
+		Series:            d.Be64(),
+		LabelIndices:      d.Be64(),
+		LabelIndicesTable: d.Be64(),
+		Postings:          d.Be64(),
+		PostingsTable:     d.Be64(),
+	}
+	if indexSize != uint64(b.Len()) {
+		return nil, errors.Errorf("index header is of an index of size %d, not %d", indexSize, b.Len())
+	}
+	if symbolsOff > sectionLimit || postingsOff > sectionLimit {
+		return nil, errors.Errorf("section offsets %d and %d out of bounds of the index header of size %d", symbolsOff, postingsOff, h.Len())
+	}
+	for _, off := range []uint64{r.toc.Symbols, r.toc.Series, r.toc.LabelIndices, r.toc.LabelIndicesTable, r.toc.Postings, r.toc.PostingsTable, postingsEnd} {
+		if off > indexSize {
+			return nil, errors.Errorf("section offset %d out of bounds of the index of size %d", off, indexSize)
+		}
+	}
+	r.postingsTableEnd = int(postingsEnd)
+
+	var err error
+	r.symbols, err = NewSymbolsWithFactor(h, r.version, int(symbolsOff), opts.SymbolsFactor)
+	if err != nil {
+		return nil, errors.Wrap(err, "read symbols")
+	}
+	if err := r.readHeaderPostingsOffsets(h, int(postingsOff)); err != nil {
+		return nil, errors.Wrap(err, "read postings offsets")
+	}
+	r.dec = &Decoder{LookupSymbol: r.lookupSymbol, Codec: opts.PostingsCodec}
+	return r, nil
+}
+
+// readHeaderPostingsOffsets reads the postings offsets section at off of the
+// index header h, and the symbols of the label names.
+func (r *Reader) readHeaderPostingsOffsets(h ByteSlice, off int) error {
+	d := encoding.NewDecbufAt(h, off, castagnoliTable)
+	r.postingsFactor = d.Uvarint()
+	n := d.Uvarint()
+	if d.Err() != nil {
+		return d.Err()
+	}
+	// Every name takes at least three bytes.
+	if r.postingsFactor < 1 || n > d.Len()/3 {
+		return errors.Errorf("invalid factor %d or number of names %d", r.postingsFactor, n)
+	}
+	r.postings = make(map[string][]postingOffset, n)
+	r.nameSymbols = make(map[uint32]string, n)
+	for i := 0; i < n && d.Err() == nil; i++ {
+		name := d.UvarintStr()
+		sym := d.Uvarint64()
+		cnt := d.Uvarint()
+		// Every value takes at least two bytes, and the first and last
+		// values of a name are always kept.
+		if cnt < 1 || cnt > d.Len()/2 || (name != "" && sym >= uint64(r.symbols.seen)) {
+			return errors.Errorf("invalid symbol %d or number of values %d of label name %q", sym, cnt, name)
+		}
+		offs := make([]postingOffset, 0, cnt)
+		for j := 0; j < cnt && d.Err() == nil; j++ {
+			value := d.UvarintStr()
+			off := d.Uvarint()
+			if off < 0 || off > r.postingsTableEnd {
+				return errors.Errorf("invalid postings offset %d of %s=%q", off, name, value)
+			}
+			offs = append(offs, postingOffset{value: value, off: off})
+		}
+		r.postings[name] = offs
+		if name != "" {
+			r.nameSymbols[uint32(sym)] = name
+		}
+	}
+	return d.Err()
+}
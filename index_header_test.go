@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+	"github.com/stretchr/testify/require"
+)
+
+// countingByteSlice counts the reads from a ByteSlice.
+type countingByteSlice struct {
+	ByteSlice
+	reads, bytes int
+}
+
+func (b *countingByteSlice) Range(start, end int) []byte {
+	b.reads++
+	b.bytes += end - start
+	return b.ByteSlice.Range(start, end)
+}
+
+// writeHeader returns the index header of r.
+func writeHeader(tb testing.TB, r *Reader) []byte {
+	var buf bytes.Buffer
+	require.NoError(tb, r.WriteHeader(&buf))
+	return buf.Bytes()
+}
+
+// requireReadersEqual requires that both readers return the same symbols, label
+// names and values, postings and series.
+func requireReadersEqual(tb testing.TB, exp, got *Reader) {
+	require.Equal(tb, readSymbols(tb, exp), readSymbols(tb, got))
+
+	names, err := exp.LabelNames()
+	require.NoError(tb, err)
+	gotNames, err := got.LabelNames()
+	require.NoError(tb, err)
+	require.Equal(tb, names, gotNames)
+	for _, name := range names {
+		values, err := exp.SortedLabelValues(name)
+		require.NoError(tb, err)
+		gotValues, err := got.SortedLabelValues(name)
+		require.NoError(tb, err)
+		require.Equal(tb, values, gotValues)
+		for _, v := range values {
+			requirePostingsEqual(tb, exp, got, name, v)
+		}
+		requirePostingsEqual(tb, exp, got, name, values...)
+		requirePostingsEqual(tb, exp, got, name, "", "\xff")
+	}
+	requirePostingsEqual(tb, exp, got, "missing", "value")
+
+	p, err := exp.Postings(AllPostingsKey())
+	require.NoError(tb, err)
+	refs, err := ExpandPostings(p)
+	require.NoError(tb, err)
+	for _, ref := range refs {
+		var (
+			lset, gotLset labels.Labels
+			chks, gotChks []chunks.Meta
+		)
+		require.NoError(tb, exp.Series(ref, &lset, &chks))
+		require.NoError(tb, got.Series(ref, &gotLset, &gotChks))
+		require.Equal(tb, lset, gotLset)
+		require.Equal(tb, chks, gotChks)
+		require.Equal(tb, lset.Get(labels.MetricName), mustLabelValueFor(tb, got, ref, labels.MetricName))
+	}
+
+	ranges, err := exp.PostingsRanges()
+	require.NoError(tb, err)
+	gotRanges, err := got.PostingsRanges()
+	require.NoError(tb, err)
+	require.Equal(tb, ranges, gotRanges)
+}
+
+func mustLabelValueFor(tb testing.TB, r *Reader, ref storage.SeriesRef, name string) string {
+	v, err := r.LabelValueFor(ref, name)
+	if err == storage.ErrNotFound {
+		return ""
+	}
+	require.NoError(tb, err)
+	return v
+}
+
+func TestIndexHeader(t *testing.T) {
+	series := generateIndexSeries(7, 2000)
+	path := filepath.Join(t.TempDir(), "index")
+	writeIndex(t, path, RoaringPostingsCodec, indexSymbols(series), series)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: roaringBitmapIndexPath, codec: RoaringPostingsCodec},
+		{path: path, codec: RoaringPostingsCodec},
+	} {
+		b, err := ioutil.ReadFile(c.path)
+		require.NoError(t, err)
+
+		for _, factor := range []int{1, 5, DefaultPostingsOffsetsFactor} {
+			t.Run(fmt.Sprintf("%s/factor=%d", c.path, factor), func(t *testing.T) {
+				opts := ReaderOptions{PostingsCodec: c.codec, PostingsOffsetsFactor: factor}
+				exp, err := NewReaderWithOptions(realByteSlice(b), opts)
+				require.NoError(t, err)
+				header := writeHeader(t, exp)
+
+				// The index is not read when opening a reader from the header.
+				index := &countingByteSlice{ByteSlice: realByteSlice(b)}
+				r, err := NewReaderFromHeader(realByteSlice(header), index, ReaderOptions{PostingsCodec: c.codec})
+				require.NoError(t, err)
+				require.Zero(t, index.reads)
+				require.Equal(t, exp.postings, r.postings)
+				require.Equal(t, exp.nameSymbols, r.nameSymbols)
+				require.Equal(t, exp.MemoryStats(), r.MemoryStats())
+
+				// Looking up a postings list reads a small part of it.
+				name := series[0].lset[0]
+				_, err = r.Postings(name.Name, name.Value)
+				require.NoError(t, err)
+				require.Less(t, index.bytes, len(b)/4)
+
+				requireReadersEqual(t, exp, r)
+
+				// Headers are the same when written from either reader.
+				require.Equal(t, header, writeHeader(t, r))
+			})
+		}
+	}
+
+	t.Run("file", func(t *testing.T) {
+		exp, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+		require.NoError(t, err)
+		defer exp.Close()
+		headerPath := path + ".header"
+		require.NoError(t, exp.WriteHeaderFile(headerPath))
+
+		r, err := NewFileReaderFromHeader(headerPath, path, ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+		require.NoError(t, err)
+		requireReadersEqual(t, exp, r)
+		require.NoError(t, r.Close())
+	})
+}
+
+func TestIndexHeaderCorruption(t *testing.T) {
+	series := generateIndexSeries(8, 100)
+	path := filepath.Join(t.TempDir(), "index")
+	writeIndex(t, path, BigEndianPostingsCodec, indexSymbols(series), series)
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	exp, err := NewReader(realByteSlice(b))
+	require.NoError(t, err)
+	header := writeHeader(t, exp)
+
+	// Every byte of the header is covered by a check.
+	for i := range header {
+		corrupted := append([]byte(nil), header...)
+		corrupted[i] ^= 0x20
+		_, err := NewReaderFromHeader(realByteSlice(corrupted), realByteSlice(b), ReaderOptions{})
+		require.Error(t, err, "byte %d", i)
+	}
+	for _, n := range []int{0, indexHeaderHeaderLen, len(header) - 1} {
+		_, err := NewReaderFromHeader(realByteSlice(header[:n]), realByteSlice(b), ReaderOptions{})
+		require.Error(t, err, "truncated to %d bytes", n)
+	}
+	// The header of another index.
+	_, err = NewReaderFromHeader(realByteSlice(header), realByteSlice(b[:len(b)-1]), ReaderOptions{})
+	require.Error(t, err)
+
+	v1, err := NewReader(realByteSlice(b))
+	require.NoError(t, err)
+	v1.version = FormatV1
+	require.Error(t, v1.WriteHeader(ioutil.Discard))
+}
+
+// headerCRCRegions returns the checksummed regions of the index header h.
+func headerCRCRegions(tb testing.TB, h []byte) []crcRegion {
+	toc := encoding.Decbuf{B: h[len(h)-indexHeaderTOCLen:]}
+	regions := []crcRegion{{start: len(h) - indexHeaderTOCLen, end: len(h) - crc32.Size}}
+	for _, off := range []uint64{toc.Be64(), toc.Be64()} {
+		d := encoding.NewDecbufAt(realByteSlice(h), int(off), nil)
+		require.NoError(tb, d.Err())
+		regions = append(regions, crcRegion{start: int(off) + 4, end: int(off) + 4 + d.Len()})
+	}
+	return regions
+}
+
+func FuzzReaderFromHeader(f *testing.F) {
+	type source struct {
+		index, header []byte
+		codec         PostingsCodec
+		regions       []crcRegion
+	}
+	var sources []source
+	for _, idx := range memoryIndexes {
+		b, err := ioutil.ReadFile(idx.path)
+		require.NoError(f, err)
+		r, err := NewReaderWithOptions(realByteSlice(b), ReaderOptions{PostingsCodec: idx.codec, PostingsOffsetsFactor: 3})
+		require.NoError(f, err)
+		h := writeHeader(f, r)
+		sources = append(sources, source{index: b, header: h, codec: idx.codec, regions: headerCRCRegions(f, h)})
+	}
+
+	f.Add(false, true, []byte{})
+	f.Add(true, true, []byte{})
+	f.Add(false, false, []byte{0, 5, 1})
+	f.Add(false, true, []byte{0x80, 100, 8, 0x80, 20, 1})
+	f.Add(true, true, []byte{0x0f, 0, 0x40, 0x10, 0, 0x7f})
+	// Mutations are given as 2 byte offsets into the header and a byte to
+	// xor there. Offsets with the highest bit set count from the end of the
+	// header.
+	f.Fuzz(func(t *testing.T, roaring, fixCRC bool, mutations []byte) {
+		src := sources[0]
+		if roaring {
+			src = sources[1]
+		}
+		h := append([]byte(nil), src.header...)
+		for ; len(mutations) >= 3; mutations = mutations[3:] {
+			off := int(mutations[0]&0x7f)<<8 | int(mutations[1])
+			if mutations[0]&0x80 != 0 {
+				off = len(h) - 1 - off
+			}
+			if off >= 0 && off < len(h) {
+				h[off] ^= mutations[2]
+			}
+		}
+		if fixCRC {
+			fixCRCs(h, src.regions)
+		}
+
+		r, err := NewReaderFromHeader(realByteSlice(h), realByteSlice(src.index), ReaderOptions{PostingsCodec: src.codec})
+		if err != nil {
+			return
+		}
+		exerciseReader(r)
+	})
+}
+
+// BenchmarkOpenIndexHeader compares opening readers from indexes and from their
+// index headers.
+func BenchmarkOpenIndexHeader(b *testing.B) {
+	for _, idx := range memoryIndexes {
+		data, err := ioutil.ReadFile(idx.path)
+		require.NoError(b, err)
+		r, err := NewReaderWithOptions(realByteSlice(data), ReaderOptions{PostingsCodec: idx.codec})
+		require.NoError(b, err)
+		header := writeHeader(b, r)
+
+		for _, c := range []struct {
+			name string
+			open func() (*Reader, error)
+		}{
+			{name: "index", open: openBytesReader(data, idx.codec)},
+			{name: "header", open: func() (*Reader, error) {
+				return NewReaderFromHeader(realByteSlice(header), realByteSlice(data), ReaderOptions{PostingsCodec: idx.codec})
+			}},
+		} {
+			b.Run(idx.codec.Name()+"/"+c.name, func(b *testing.B) {
+				b.ReportAllocs()
+				readers, heap := openReadersHeap(b, b.N, c.open)
+				b.ReportMetric(float64(heap), "heap-B/reader")
+				b.ReportMetric(float64(len(header)), "header-B")
+				b.ReportMetric(float64(len(data)), "index-B")
+				runtime.KeepAlive(readers)
+			})
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// WeightedMatchers is a set of matchers and its share of a workload.
+type WeightedMatchers struct {
+	Matchers []*labels.Matcher
+	Weight   float64
+}
+
+// LoadConfig configures a run of RunLoad.
+type LoadConfig struct {
+	// Workers is the number of goroutines issuing queries concurrently.
+	Workers int
+	// Duration is how long queries are issued for.
+	Duration time.Duration
+	// Queries are picked at random by their weight.
+	Queries []WeightedMatchers
+	// ReadSeries makes every query also read the labels and chunks of the
+	// matching series, as the series API does.
+	ReadSeries bool
+	// Seed for picking queries, so that runs issue the same sequence.
+	Seed int64
+}
+
+// LatencySummary summarizes the latencies of queries.
+type LatencySummary struct {
+	Mean, P50, P90, P99, P999, Max time.Duration
+}
+
+// GCSummary summarizes the garbage collection during a run.
+type GCSummary struct {
+	NumGC                  uint32
+	PauseTotal             time.Duration
+	PauseP99, PauseMax     time.Duration
+	AllocBytesPerQuery     float64
+	AllocObjectsPerQuery   float64
+	HeapInUseBytesAtFinish uint64
+}
+
+// LoadResult is the outcome of a run of RunLoad.
+type LoadResult struct {
+	Queries  int
+	Errors   int
+	Duration time.Duration
+	// Counts holds how often each query of the workload was issued.
+	Counts     []int
+	Throughput float64 // Queries per second.
+	Latency    LatencySummary
+	GC         GCSummary
+}
+
+// RunLoad issues the weighted queries of cfg against ix from cfg.Workers
+// goroutines until cfg.Duration has passed or ctx is done, and summarizes
+// their latencies and the garbage collection they caused.
+func RunLoad(ctx context.Context, ix *Reader, cfg LoadConfig) (*LoadResult, error) {
+	if cfg.Workers < 1 {
+		return nil, errors.Errorf("invalid number of workers %d", cfg.Workers)
+	}
+	cumWeights := make([]float64, 0, len(cfg.Queries))
+	var total float64
+	for _, q := range cfg.Queries {
+		if q.Weight < 0 {
+			return nil, errors.Errorf("negative weight %v for %s", q.Weight, MatchersKey(q.Matchers...))
+		}
+		total += q.Weight
+		cumWeights = append(cumWeights, total)
+	}
+	if total == 0 {
+		return nil, errors.New("no queries with a positive weight")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	type workerResult struct {
+		latencies []time.Duration
+		counts    []int
+		errors    int
+		err       error
+	}
+	var (
+		wg      sync.WaitGroup
+		results = make([]workerResult, cfg.Workers)
+		before  runtime.MemStats
+		after   runtime.MemStats
+	)
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for i := range results {
+		wg.Add(1)
+		go func(res *workerResult, seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			res.counts = make([]int, len(cfg.Queries))
+			var chks []chunks.Meta
+			var lset labels.Labels
+			for ctx.Err() == nil {
+				q := sort.SearchFloat64s(cumWeights, rng.Float64()*total)
+				// Skip over queries of zero weight sharing the cumulative weight.
+				for cfg.Queries[q].Weight == 0 {
+					q++
+				}
+
+				qstart := time.Now()
+				err := runQuery(ctx, ix, cfg.Queries[q].Matchers, cfg.ReadSeries, &lset, &chks)
+				if err != nil && ctx.Err() != nil {
+					// Queries cut short by the end of the run are not counted.
+					return
+				}
+				res.latencies = append(res.latencies, time.Since(qstart))
+				res.counts[q]++
+				if err != nil {
+					res.errors++
+					res.err = err
+				}
+			}
+		}(&results[i], cfg.Seed+int64(i))
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	res := &LoadResult{
+		Duration: elapsed,
+		Counts:   make([]int, len(cfg.Queries)),
+	}
+	var latencies []time.Duration
+	var lastErr error
+	for _, r := range results {
+		latencies = append(latencies, r.latencies...)
+		for i, c := range r.counts {
+			res.Counts[i] += c
+		}
+		res.Errors += r.errors
+		if r.err != nil {
+			lastErr = r.err
+		}
+	}
+	res.Queries = len(latencies)
+	res.Throughput = float64(res.Queries) / elapsed.Seconds()
+	res.Latency = summarizeLatencies(latencies)
+	res.GC = summarizeGC(&before, &after, res.Queries)
+	if res.Errors > 0 {
+		return res, errors.Wrapf(lastErr, "%d of %d queries failed, last error", res.Errors, res.Queries)
+	}
+	return res, nil
+}
+
+func runQuery(ctx context.Context, ix *Reader, ms []*labels.Matcher, readSeries bool, lset *labels.Labels, chks *[]chunks.Meta) error {
+	p, err := PostingsForMatchers(ix, ms...)
+	if err != nil {
+		return err
+	}
+	p = NewContextPostings(ctx, p)
+	if !readSeries {
+		_, err := ExpandPostings(p)
+		return err
+	}
+	for p.Next() {
+		if err := ix.Series(p.At(), lset, chks); err != nil {
+			return err
+		}
+	}
+	return p.Err()
+}
+
+// quantile returns the q-quantile of the sorted durations.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func summarizeLatencies(latencies []time.Duration) LatencySummary {
+	if len(latencies) == 0 {
+		return LatencySummary{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	return LatencySummary{
+		Mean: sum / time.Duration(len(latencies)),
+		P50:  quantile(latencies, 0.5),
+		P90:  quantile(latencies, 0.9),
+		P99:  quantile(latencies, 0.99),
+		P999: quantile(latencies, 0.999),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+func summarizeGC(before, after *runtime.MemStats, queries int) GCSummary {
+	s := GCSummary{
+		NumGC:                  after.NumGC - before.NumGC,
+		PauseTotal:             time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+		HeapInUseBytesAtFinish: after.HeapInuse,
+	}
+	if queries > 0 {
+		s.AllocBytesPerQuery = float64(after.TotalAlloc-before.TotalAlloc) / float64(queries)
+		s.AllocObjectsPerQuery = float64(after.Mallocs-before.Mallocs) / float64(queries)
+	}
+
+	// Only the most recent pauses are kept in a circular buffer.
+	n := s.NumGC
+	if n > uint32(len(after.PauseNs)) {
+		n = uint32(len(after.PauseNs))
+	}
+	pauses := make([]time.Duration, 0, n)
+	for i := uint32(0); i < n; i++ {
+		pauses = append(pauses, time.Duration(after.PauseNs[(after.NumGC-i+255)%256]))
+	}
+	sort.Slice(pauses, func(i, j int) bool { return pauses[i] < pauses[j] })
+	s.PauseP99 = quantile(pauses, 0.99)
+	if len(pauses) > 0 {
+		s.PauseMax = pauses[len(pauses)-1]
+	}
+	return s
+}
+
+// WriteLoadReport writes the results of load runs, named by their encoding,
+// as a table to w.
+func WriteLoadReport(w io.Writer, names []string, results []*LoadResult) error {
+	_, err := fmt.Fprintf(w, "%-16s %10s %8s %12s %10s %10s %10s %10s %10s %6s %12s %10s %12s %12s\n",
+		"encoding", "queries", "errors", "queries/s", "p50", "p90", "p99", "p999", "max",
+		"gcs", "gc-pause", "pause-p99", "B/query", "allocs/query")
+	if err != nil {
+		return err
+	}
+	for i, r := range results {
+		if _, err := fmt.Fprintf(w, "%-16s %10d %8d %12.1f %10s %10s %10s %10s %10s %6d %12s %10s %12.0f %12.1f\n",
+			names[i], r.Queries, r.Errors, r.Throughput,
+			r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.P999, r.Latency.Max,
+			r.GC.NumGC, r.GC.PauseTotal, r.GC.PauseP99, r.GC.AllocBytesPerQuery, r.GC.AllocObjectsPerQuery,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunLoad(t *testing.T) {
+	ir, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(t, err)
+	defer ir.Close()
+
+	queries := []WeightedMatchers{
+		{Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "demo")}, Weight: 0},
+		{Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "prometheus")}, Weight: 3},
+		{Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", "go_.*")}, Weight: 1},
+		{Matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "job", "robust")}, Weight: 0},
+	}
+	for _, readSeries := range []bool{false, true} {
+		res, err := RunLoad(context.Background(), ir, LoadConfig{
+			Workers:    4,
+			Duration:   200 * time.Millisecond,
+			Queries:    queries,
+			ReadSeries: readSeries,
+		})
+		require.NoError(t, err)
+		require.Greater(t, res.Queries, 0)
+		require.Zero(t, res.Errors)
+		require.Equal(t, res.Queries, res.Counts[0]+res.Counts[1]+res.Counts[2]+res.Counts[3])
+		require.Zero(t, res.Counts[0])
+		require.Zero(t, res.Counts[3])
+		require.Greater(t, res.Counts[1], res.Counts[2])
+
+		l := res.Latency
+		require.True(t, l.P50 <= l.P90 && l.P90 <= l.P99 && l.P99 <= l.P999 && l.P999 <= l.Max, "unordered quantiles %+v", l)
+		require.Greater(t, res.Throughput, 0.0)
+		require.Greater(t, res.GC.AllocBytesPerQuery, 0.0)
+
+		var buf bytes.Buffer
+		require.NoError(t, WriteLoadReport(&buf, []string{"big_endian"}, []*LoadResult{res}))
+		require.Contains(t, buf.String(), "big_endian")
+	}
+
+	_, err = RunLoad(context.Background(), ir, LoadConfig{Workers: 1, Duration: time.Millisecond, Queries: queries[:1]})
+	require.Error(t, err)
+}
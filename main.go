@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+)
+
+// Indexes of the same block written by upstream Prometheus and by the fork
+// storing postings as roaring bitmaps.
+const (
+	bigEndianIndexPath     = "data/index_big_endian"
+	roaringBitmapIndexPath = "data/index_roaring_bitmap"
+)
+
+const usage = `usage: %s <command> [flags]
+
+Commands:
+  serve     Serve the Prometheus HTTP API endpoints for labels and series of an index.
+  convert   Rewrite an index with another postings codec.
+  loadgen   Run concurrent queries against indexes and report latencies and GC.
+  compare   Check that indexes return the same series for queries, and time them.
+  stats     Print the highest cardinality metrics, labels and label pairs of an index,
+            or with -size-codec the labels whose postings take the most bytes.
+  fixtures  Build the blocks the query benchmarks run against from the series of an index.
+  header    Write the index header of an index, from which readers start without reading it.
+  objstore  Serve the files of a directory as an object store supporting range requests.
+
+Run '%[1]s <command> -h' for the flags of a command.
+`
+
+func main() {
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "serve":
+		err = runServe(logger, args)
+	case "convert":
+		err = runConvert(logger, args)
+	case "loadgen":
+		err = runLoadgen(logger, args)
+	case "compare":
+		err = runCompare(logger, args)
+	case "stats":
+		err = runStats(args)
+	case "fixtures":
+		err = runFixtures(logger, args)
+	case "header":
+		err = runHeader(logger, args)
+	case "objstore":
+		err = runObjectStore(logger, args)
+	default:
+		fmt.Fprintf(os.Stderr, usage, os.Args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Log("msg", "command failed", "cmd", os.Args[1], "err", err)
+		os.Exit(1)
+	}
+}
+
+// openIndex opens the index file at path, whose postings were written with
+// the codec of the given name.
+func openIndex(path, codecName string) (*Reader, error) {
+	codec, err := PostingsCodecByName(codecName)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: codec})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open index %s", path)
+	}
+	return r, nil
+}
+
+func runServe(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listenAddress := fs.String("listen-address", "localhost:9095", "Address to listen on for HTTP requests.")
+	indexPath := fs.String("index", bigEndianIndexPath, "Path of the index file to serve.")
+	codecName := fs.String("codec", BigEndianPostingsCodec.Name(), "Postings codec the index was written with.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	r, err := openIndex(*indexPath, *codecName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	mux := http.NewServeMux()
+	NewAPI(r).Register(mux)
+	logger.Log("msg", "serving index", "index", *indexPath, "codec", *codecName, "address", *listenAddress)
+	return listenAndServe(logger, &http.Server{Addr: *listenAddress, Handler: mux})
+}
+
+// listenAndServe runs srv until it fails or the process is terminated.
+func listenAndServe(logger log.Logger, srv *http.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		return err
+	case <-term:
+		logger.Log("msg", "shutting down")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+func runConvert(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	indexPath := fs.String("index", bigEndianIndexPath, "Path of the index file to convert.")
+	codecName := fs.String("codec", BigEndianPostingsCodec.Name(), "Postings codec the index was written with.")
+	outPath := fs.String("out", "", "Path to write the converted index to.")
+	outCodecName := fs.String("out-codec", RoaringPostingsCodec.Name(), "Postings codec to write the converted index with.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *outPath == "" {
+		return errors.New("no -out path given")
+	}
+	outCodec, err := PostingsCodecByName(*outCodecName)
+	if err != nil {
+		return err
+	}
+
+	r, err := openIndex(*indexPath, *codecName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err := CompactIndexes(context.Background(), *outPath, outCodec, nil, r); err != nil {
+		return errors.Wrap(err, "convert index")
+	}
+	logger.Log("msg", "converted index", "index", *indexPath, "out", *outPath, "codec", outCodec.Name())
+	return nil
+}
+
+// stringsFlag is a flag that may be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ", ") }
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// defaultIndexes are the indexes of the same block in data/, as given to the
+// -index flag.
+var defaultIndexes = stringsFlag{
+	BigEndianPostingsCodec.Name() + "=" + bigEndianIndexPath,
+	RoaringPostingsCodec.Name() + "=" + roaringBitmapIndexPath,
+}
+
+// openIndexes opens the indexes given as <codec>=<path>, and returns them with
+// their codec names.
+func openIndexes(indexes []string) ([]string, []*Reader, error) {
+	var (
+		names   []string
+		readers []*Reader
+	)
+	for _, idx := range indexes {
+		i := strings.Index(idx, "=")
+		if i < 0 {
+			closeAll(readers)
+			return nil, nil, errors.Errorf("invalid index %q, expected <codec>=<path>", idx)
+		}
+		r, err := openIndex(idx[i+1:], idx[:i])
+		if err != nil {
+			closeAll(readers)
+			return nil, nil, err
+		}
+		names = append(names, idx[:i])
+		readers = append(readers, r)
+	}
+	return names, readers, nil
+}
+
+func closeAll(readers []*Reader) {
+	for _, r := range readers {
+		r.Close()
+	}
+}
+
+// loadQueries returns the queries of the workload file, or the given selectors
+// with equal weights if there are any.
+func loadQueries(workload string, selectors []string) ([]WorkloadQuery, error) {
+	if len(selectors) == 0 {
+		return LoadWorkloadFile(workload)
+	}
+	var queries []WorkloadQuery
+	for _, s := range selectors {
+		q, err := parseWorkloadLine(s)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, nil
+}
+
+func runLoadgen(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	indexes, selectors := stringsFlag{}, stringsFlag{}
+	fs.Var(&indexes, "index", "Index to query as <codec>=<path>, may be repeated. Defaults to both indexes in data/.")
+	workload := fs.String("workload", "data/loadgen.workload", "Workload file of the queries to run.")
+	fs.Var(&selectors, "query", "Series selector to query instead of the workload, may be repeated.")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "Number of concurrent workers.")
+	duration := fs.Duration("duration", 10*time.Second, "How long to run the load against each index.")
+	readSeries := fs.Bool("series", false, "Also read the matching series of every query.")
+	seed := fs.Int64("seed", 1, "Seed for picking queries.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		indexes = defaultIndexes
+	}
+
+	queries, err := loadQueries(*workload, selectors)
+	if err != nil {
+		return err
+	}
+	names, readers, err := openIndexes(indexes)
+	if err != nil {
+		return err
+	}
+	defer closeAll(readers)
+
+	results := make([]*LoadResult, 0, len(readers))
+	for i, r := range readers {
+		logger.Log("msg", "running load", "index", indexes[i], "workers", *workers, "duration", *duration)
+		res, err := RunLoad(context.Background(), r, LoadConfig{
+			Workers:    *workers,
+			Duration:   *duration,
+			Queries:    weightedMatchers(queries),
+			ReadSeries: *readSeries,
+			Seed:       *seed,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "run load against %s", indexes[i])
+		}
+		results = append(results, res)
+	}
+	return WriteLoadReport(os.Stdout, names, results)
+}
+
+func runCompare(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	indexes, selectors := stringsFlag{}, stringsFlag{}
+	fs.Var(&indexes, "index", "Index to query as <codec>=<path>, may be repeated. Defaults to both indexes in data/.")
+	workload := fs.String("workload", "data/queries.workload", "Workload file of the queries to compare.")
+	fs.Var(&selectors, "query", "Series selector to compare instead of the workload, may be repeated.")
+	runs := fs.Int("runs", 10, "Number of runs of every query, of which the median latency is reported.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		indexes = defaultIndexes
+	}
+
+	queries, err := loadQueries(*workload, selectors)
+	if err != nil {
+		return err
+	}
+	names, readers, err := openIndexes(indexes)
+	if err != nil {
+		return err
+	}
+	defer closeAll(readers)
+
+	logger.Log("msg", "comparing indexes", "indexes", indexes.String(), "queries", len(queries))
+	return CompareWorkload(os.Stdout, queries, names, readers, *runs)
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	indexPath := fs.String("index", bigEndianIndexPath, "Path of the index file.")
+	codecName := fs.String("codec", BigEndianPostingsCodec.Name(), "Postings codec the index was written with.")
+	label := fs.String("label", "__name__", "Label whose values are reported as metrics.")
+	limit := fs.Int("limit", 10, "Number of entries to report per statistic.")
+	format := fs.String("format", "table", "Output format, table or json.")
+	sizeCodecs := stringsFlag{}
+	fs.Var(&sizeCodecs, "size-codec", "Report the bytes taken by postings lists written with this codec instead of cardinalities, may be repeated.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return errors.Errorf("unknown format %q", *format)
+	}
+	if *limit < 0 {
+		return errors.Errorf("negative limit %d", *limit)
+	}
+
+	r, err := openIndex(*indexPath, *codecName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if len(sizeCodecs) > 0 {
+		codecs := make([]PostingsCodec, 0, len(sizeCodecs))
+		for _, name := range sizeCodecs {
+			codec, err := PostingsCodecByName(name)
+			if err != nil {
+				return err
+			}
+			codecs = append(codecs, codec)
+		}
+		stats, err := r.PostingsSizeStats(codecs, *limit)
+		if err != nil {
+			return err
+		}
+		if *format == "json" {
+			return stats.WriteJSON(os.Stdout)
+		}
+		return stats.WriteTable(os.Stdout)
+	}
+
+	stats, err := r.Stats(*label, *limit)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		return stats.WriteJSON(os.Stdout)
+	}
+	return stats.WriteTable(os.Stdout)
+}
+
+func runFixtures(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("fixtures", flag.ExitOnError)
+	indexPath := fs.String("index", bigEndianIndexPath, "Path of the index file whose series are written to the blocks.")
+	codecName := fs.String("codec", BigEndianPostingsCodec.Name(), "Postings codec the index was written with.")
+	beDir := fs.String("big-endian-block", bigEndianBlockPath, "Directory to write the block of upstream Prometheus to.")
+	rbDir := fs.String("roaring-bitmap-block", roaringBitmapBlockPath, "Directory to write the block of the roaring bitmap fork to.")
+	samples := fs.Int("samples", DefaultFixtureOptions.Samples, "Number of samples of every series.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	r, err := openIndex(*indexPath, *codecName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	opts := DefaultFixtureOptions
+	opts.Samples = *samples
+	start := time.Now()
+	if err := BuildFixtureBlocks(context.Background(), logger, r, *beDir, *rbDir, opts); err != nil {
+		return errors.Wrap(err, "build fixture blocks")
+	}
+	logger.Log("msg", "built fixture blocks", "big_endian", *beDir, "roaring_bitmap", *rbDir, "duration", time.Since(start))
+	return nil
+}
+
+func runHeader(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("header", flag.ExitOnError)
+	indexPath := fs.String("index", bigEndianIndexPath, "Path of the index file.")
+	codecName := fs.String("codec", BigEndianPostingsCodec.Name(), "Postings codec the index was written with.")
+	outPath := fs.String("out", "", "Path to write the index header to. Defaults to the index path with a .header suffix.")
+	factor := fs.Int("postings-offsets-factor", DefaultPostingsOffsetsFactor, "Sampling factor of the postings offsets kept in the header.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *outPath == "" {
+		*outPath = *indexPath + ".header"
+	}
+	codec, err := PostingsCodecByName(*codecName)
+	if err != nil {
+		return err
+	}
+
+	r, err := NewFileReaderWithOptions(*indexPath, ReaderOptions{PostingsCodec: codec, PostingsOffsetsFactor: *factor})
+	if err != nil {
+		return errors.Wrapf(err, "open index %s", *indexPath)
+	}
+	defer r.Close()
+
+	if err := r.WriteHeaderFile(*outPath); err != nil {
+		return errors.Wrap(err, "write index header")
+	}
+	logger.Log("msg", "wrote index header", "index", *indexPath, "out", *outPath)
+	return nil
+}
+
+func runObjectStore(logger log.Logger, args []string) error {
+	fs := flag.NewFlagSet("objstore", flag.ExitOnError)
+	listenAddress := fs.String("listen-address", "localhost:9096", "Address to listen on for HTTP requests.")
+	dir := fs.String("dir", "data", "Directory whose files are served as objects.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	logger.Log("msg", "serving objects", "dir", *dir, "address", *listenAddress)
+	return listenAndServe(logger, &http.Server{Addr: *listenAddress, Handler: NewObjectStoreHandler(*dir)})
+}
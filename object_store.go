@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ObjectStore reads byte ranges of objects, as from the object storage that
+// long-term storage systems keep blocks in.
+type ObjectStore interface {
+	// ObjectSize returns the size of the object name.
+	ObjectSize(ctx context.Context, name string) (int64, error)
+	// GetRange returns length bytes of the object name from off.
+	GetRange(ctx context.Context, name string, off, length int64) ([]byte, error)
+}
+
+// FileObjectStore is an ObjectStore of the files in a directory, opened for
+// every request.
+type FileObjectStore struct {
+	Dir string
+}
+
+func (s FileObjectStore) path(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// ObjectSize implements ObjectStore.
+func (s FileObjectStore) ObjectSize(_ context.Context, name string) (int64, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// GetRange implements ObjectStore.
+func (s FileObjectStore) GetRange(_ context.Context, name string, off, length int64) ([]byte, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, length)
+	if _, err := f.ReadAt(b, off); err != nil {
+		return nil, errors.Wrapf(err, "read %d bytes of %s at %d", length, name, off)
+	}
+	return b, nil
+}
+
+// HTTPObjectStore is an ObjectStore of the objects served under a URL, read
+// with HTTP range requests.
+type HTTPObjectStore struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// NewObjectStoreHandler returns a handler serving the files in dir as objects
+// of an HTTPObjectStore, supporting range requests.
+func NewObjectStoreHandler(dir string) http.Handler {
+	return http.FileServer(http.Dir(dir))
+}
+
+func (s HTTPObjectStore) do(ctx context.Context, method, name string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(u.Path, name)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// ObjectSize implements ObjectStore.
+func (s HTTPObjectStore) ObjectSize(ctx context.Context, name string) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("get size of %s: %s", name, resp.Status)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "get size of %s", name)
+	}
+	return size, nil
+}
+
+// GetRange implements ObjectStore.
+func (s HTTPObjectStore) GetRange(ctx context.Context, name string, off, length int64) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, http.Header{
+		"Range": []string{fmt.Sprintf("bytes=%d-%d", off, off+length-1)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, errors.Errorf("get %d bytes of %s at %d: %s", length, name, off, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, length+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %d bytes of %s at %d", length, name, off)
+	}
+	if int64(len(b)) != length {
+		return nil, errors.Errorf("got %d bytes of %s at %d instead of %d", len(b), name, off, length)
+	}
+	return b, nil
+}
+
+// ObjectReadStats counts the reads of an ObjectByteSlice.
+type ObjectReadStats struct {
+	// Ranges is the number of ranges read from the slice, and RangeBytes
+	// their size.
+	Ranges     int64
+	RangeBytes int64
+	// Requests is the number of requests to the object store, and
+	// FetchedBytes their size.
+	Requests     int64
+	FetchedBytes int64
+}
+
+// ObjectByteSliceOptions configures an ObjectByteSlice.
+type ObjectByteSliceOptions struct {
+	// Size of the object. It is requested from the store if 0.
+	Size int64
+	// PageSize is the granularity of requests and of the cache of fetched
+	// bytes. Defaults to DefaultObjectPageSize.
+	PageSize int
+}
+
+// DefaultObjectPageSize is the default ObjectByteSliceOptions.PageSize.
+const DefaultObjectPageSize = 16 << 10
+
+// ObjectByteSlice is a ByteSlice of an object in an ObjectStore. Bytes are
+// fetched on demand in pages, which are kept for later reads. The missing
+// pages of a range are coalesced into a single request per run of
+// consecutive pages. Concurrent reads wait for the pages that are being
+// fetched already rather than requesting them again.
+//
+// As ByteSlice can't return errors, a failed request makes Range return
+// zeroes, which then fail checksums or decoding. The error is kept for Err.
+type ObjectByteSlice struct {
+	ctx      context.Context
+	store    ObjectStore
+	name     string
+	size     int
+	pageSize int
+
+	mtx   sync.Mutex
+	pages map[int][]byte
+	// fetching holds the pages being fetched, with a channel closed once
+	// their request is done.
+	fetching map[int]chan struct{}
+	stats    ObjectReadStats
+	err      error
+}
+
+// NewObjectByteSlice returns a ByteSlice of the object name in store. Requests
+// are made with ctx.
+func NewObjectByteSlice(ctx context.Context, store ObjectStore, name string, opts ObjectByteSliceOptions) (*ObjectByteSlice, error) {
+	if opts.PageSize == 0 {
+		opts.PageSize = DefaultObjectPageSize
+	}
+	if opts.PageSize < 0 {
+		return nil, errors.Errorf("invalid page size %d", opts.PageSize)
+	}
+	b := &ObjectByteSlice{
+		ctx:      ctx,
+		store:    store,
+		name:     name,
+		size:     int(opts.Size),
+		pageSize: opts.PageSize,
+		pages:    map[int][]byte{},
+		fetching: map[int]chan struct{}{},
+	}
+	if b.size == 0 {
+		size, err := store.ObjectSize(ctx, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get size of %s", name)
+		}
+		b.stats.Requests++
+		b.size = int(size)
+	}
+	return b, nil
+}
+
+// Len implements ByteSlice.
+func (b *ObjectByteSlice) Len() int {
+	return b.size
+}
+
+// Range implements ByteSlice.
+func (b *ObjectByteSlice) Range(start, end int) []byte {
+	if start < 0 || end > b.size || start > end {
+		panic(fmt.Sprintf("range [%d:%d] out of bounds of an object of %d bytes", start, end, b.size))
+	}
+	b.mtx.Lock()
+	b.stats.Ranges++
+	b.stats.RangeBytes += int64(end - start)
+	if start == end {
+		b.mtx.Unlock()
+		return []byte{}
+	}
+	first, last := start/b.pageSize, (end-1)/b.pageSize
+	var (
+		runs []objectPageRun
+		wait []chan struct{}
+	)
+	for p := first; p <= last; p++ {
+		if _, ok := b.pages[p]; ok {
+			continue
+		}
+		if done, ok := b.fetching[p]; ok {
+			if n := len(wait); n == 0 || wait[n-1] != done {
+				wait = append(wait, done)
+			}
+			continue
+		}
+		if n := len(runs); n > 0 && runs[n-1].last == p-1 {
+			runs[n-1].last = p
+		} else {
+			runs = append(runs, objectPageRun{first: p, last: p, done: make(chan struct{})})
+		}
+		b.fetching[p] = runs[len(runs)-1].done
+	}
+	b.mtx.Unlock()
+
+	for _, run := range runs {
+		b.fetch(run)
+	}
+	for _, done := range wait {
+		<-done
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if first == last {
+		off := first * b.pageSize
+		return b.page(first)[start-off : end-off]
+	}
+	res := make([]byte, 0, end-start)
+	for p := first; p <= last; p++ {
+		page := b.page(p)
+		lo, hi := 0, len(page)
+		if p == first {
+			lo = start - p*b.pageSize
+		}
+		if p == last {
+			hi = end - p*b.pageSize
+		}
+		res = append(res, page[lo:hi]...)
+	}
+	return res
+}
+
+// page returns the page p, or zeroes if it failed to be fetched.
+func (b *ObjectByteSlice) page(p int) []byte {
+	if page, ok := b.pages[p]; ok {
+		return page
+	}
+	end := (p + 1) * b.pageSize
+	if end > b.size {
+		end = b.size
+	}
+	return make([]byte, end-p*b.pageSize)
+}
+
+// objectPageRun is a run of consecutive pages fetched in a single request,
+// with a channel closed once it is done.
+type objectPageRun struct {
+	first, last int
+	done        chan struct{}
+}
+
+// fetch fetches the pages of run in a single request.
+func (b *ObjectByteSlice) fetch(run objectPageRun) {
+	first, last := run.first, run.last
+	off := first * b.pageSize
+	end := (last + 1) * b.pageSize
+	if end > b.size {
+		end = b.size
+	}
+	buf, err := b.store.GetRange(b.ctx, b.name, int64(off), int64(end-off))
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	defer close(run.done)
+	for p := first; p <= last; p++ {
+		delete(b.fetching, p)
+	}
+	b.stats.Requests++
+	if err != nil {
+		if b.err == nil {
+			b.err = errors.Wrapf(err, "fetch %d bytes of %s at %d", end-off, b.name, off)
+		}
+		return
+	}
+	b.stats.FetchedBytes += int64(len(buf))
+	for p := first; p <= last; p++ {
+		lo := (p - first) * b.pageSize
+		hi := lo + b.pageSize
+		if hi > len(buf) {
+			hi = len(buf)
+		}
+		b.pages[p] = buf[lo:hi:hi]
+	}
+}
+
+// Stats returns the reads from the slice so far.
+func (b *ObjectByteSlice) Stats() ObjectReadStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.stats
+}
+
+// Err returns the first error fetching bytes of the object.
+func (b *ObjectByteSlice) Err() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// objectStores returns the object stores of the files in dir.
+func objectStores(tb testing.TB, dir string) map[string]ObjectStore {
+	srv := httptest.NewServer(NewObjectStoreHandler(dir))
+	tb.Cleanup(srv.Close)
+	return map[string]ObjectStore{
+		"file": FileObjectStore{Dir: dir},
+		"http": HTTPObjectStore{URL: srv.URL},
+	}
+}
+
+func TestObjectByteSlice(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(data)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "object"), data, 0o666))
+
+	for storeName, store := range objectStores(t, dir) {
+		t.Run(storeName, func(t *testing.T) {
+			size, err := store.ObjectSize(context.Background(), "object")
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), size)
+			_, err = store.ObjectSize(context.Background(), "missing")
+			require.Error(t, err)
+			_, err = NewObjectByteSlice(context.Background(), store, "missing", ObjectByteSliceOptions{})
+			require.Error(t, err)
+			_, err = store.GetRange(context.Background(), "object", int64(len(data))-10, 20)
+			require.Error(t, err)
+
+			for _, pageSize := range []int{1, 7, 4096, DefaultObjectPageSize, 2 * len(data)} {
+				t.Run(fmt.Sprintf("page=%d", pageSize), func(t *testing.T) {
+					b, err := NewObjectByteSlice(context.Background(), store, "object", ObjectByteSliceOptions{PageSize: pageSize})
+					require.NoError(t, err)
+					require.Equal(t, len(data), b.Len())
+					require.Equal(t, ObjectReadStats{Requests: 1}, b.Stats())
+
+					rnd := rand.New(rand.NewSource(int64(pageSize)))
+					for i := 0; i < 200; i++ {
+						start := rnd.Intn(len(data))
+						end := start + rnd.Intn(len(data)-start+1)
+						if i%2 == 0 {
+							end = start + rnd.Intn(100)
+							if end > len(data) {
+								end = len(data)
+							}
+						}
+						require.Equal(t, data[start:end], b.Range(start, end), "[%d:%d]", start, end)
+					}
+					require.Equal(t, data, b.Range(0, len(data)))
+					require.NoError(t, b.Err())
+
+					stats := b.Stats()
+					require.Equal(t, int64(201), stats.Ranges)
+					// Every page is fetched once.
+					require.Equal(t, int64(len(data)), stats.FetchedBytes)
+				})
+			}
+		})
+	}
+}
+
+func TestObjectByteSliceCoalescing(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 10*100)
+	rand.New(rand.NewSource(2)).Read(data)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "object"), data, 0o666))
+
+	b, err := NewObjectByteSlice(context.Background(), FileObjectStore{Dir: dir}, "object", ObjectByteSliceOptions{
+		Size:     int64(len(data)),
+		PageSize: 100,
+	})
+	require.NoError(t, err)
+	require.Equal(t, ObjectReadStats{}, b.Stats())
+
+	for _, c := range []struct {
+		start, end        int
+		requests, fetched int64
+	}{
+		// Pages 2 to 4 in a single request.
+		{start: 250, end: 450, requests: 1, fetched: 300},
+		// Cached pages.
+		{start: 200, end: 500, requests: 1, fetched: 300},
+		// Pages 0 to 1 and 5 to 6 around the cached ones.
+		{start: 50, end: 650, requests: 3, fetched: 700},
+		// Page 9, which is the last one.
+		{start: 999, end: 1000, requests: 4, fetched: 800},
+		{start: 500, end: 500, requests: 4, fetched: 800},
+	} {
+		require.Equal(t, data[c.start:c.end], b.Range(c.start, c.end))
+		stats := b.Stats()
+		require.Equal(t, c.requests, stats.Requests, "[%d:%d]", c.start, c.end)
+		require.Equal(t, c.fetched, stats.FetchedBytes, "[%d:%d]", c.start, c.end)
+	}
+	require.Panics(t, func() { b.Range(0, len(data)+1) })
+
+	// Failed requests return zeroes, and are retried.
+	failing, err := NewObjectByteSlice(context.Background(), FileObjectStore{Dir: dir}, "object", ObjectByteSliceOptions{
+		Size:     int64(len(data)) + 100,
+		PageSize: 100,
+	})
+	require.NoError(t, err)
+	require.Equal(t, data[:200], failing.Range(0, 200))
+	require.Equal(t, make([]byte, 150), failing.Range(950, 1100))
+	require.Error(t, failing.Err())
+	failing.Range(1000, 1100)
+	require.Equal(t, int64(3), failing.Stats().Requests)
+}
+
+// blockingObjectStore is an ObjectStore whose requests wait for release, and
+// which counts the requests for every offset.
+type blockingObjectStore struct {
+	ObjectStore
+	release chan struct{}
+
+	mtx      sync.Mutex
+	requests map[int64]int
+}
+
+func (s *blockingObjectStore) GetRange(ctx context.Context, name string, off, length int64) ([]byte, error) {
+	s.mtx.Lock()
+	s.requests[off]++
+	s.mtx.Unlock()
+	<-s.release
+	return s.ObjectStore.GetRange(ctx, name, off, length)
+}
+
+func TestObjectByteSliceConcurrentRanges(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 10*100)
+	rand.New(rand.NewSource(3)).Read(data)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "object"), data, 0o666))
+
+	store := &blockingObjectStore{
+		ObjectStore: FileObjectStore{Dir: dir},
+		release:     make(chan struct{}),
+		requests:    map[int64]int{},
+	}
+	b, err := NewObjectByteSlice(context.Background(), store, "object", ObjectByteSliceOptions{
+		Size:     int64(len(data)),
+		PageSize: 100,
+	})
+	require.NoError(t, err)
+
+	// Overlapping ranges read at once wait for the pages others fetch.
+	var (
+		started, done sync.WaitGroup
+		ranges        = [][2]int{{0, 1000}, {150, 450}, {250, 950}, {0, 100}, {999, 1000}}
+		got           = make([][]byte, 4*len(ranges))
+	)
+	for i := range got {
+		started.Add(1)
+		done.Add(1)
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			rng := ranges[i%len(ranges)]
+			got[i] = b.Range(rng[0], rng[1])
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(store.release)
+	done.Wait()
+
+	for i, g := range got {
+		rng := ranges[i%len(ranges)]
+		require.Equal(t, data[rng[0]:rng[1]], g, "%v", rng)
+	}
+	require.NoError(t, b.Err())
+	// Every page is fetched once.
+	require.Equal(t, int64(len(data)), b.Stats().FetchedBytes)
+	for off, n := range store.requests {
+		require.Equal(t, 1, n, "requests at %d", off)
+	}
+}
+
+func TestReaderFromObjectStore(t *testing.T) {
+	for _, idx := range memoryIndexes {
+		t.Run(idx.codec.Name(), func(t *testing.T) {
+			exp, err := NewFileReaderWithOptions(idx.path, ReaderOptions{PostingsCodec: idx.codec})
+			require.NoError(t, err)
+			defer exp.Close()
+			header := writeHeader(t, exp)
+
+			for storeName, store := range objectStores(t, filepath.Dir(idx.path)) {
+				b, err := NewObjectByteSlice(context.Background(), store, filepath.Base(idx.path), ObjectByteSliceOptions{PageSize: 1024})
+				require.NoError(t, err)
+				r, err := NewReaderFromHeader(realByteSlice(header), b, ReaderOptions{PostingsCodec: idx.codec})
+				require.NoError(t, err, storeName)
+				require.Equal(t, int64(1), b.Stats().Requests)
+
+				requireReadersEqual(t, exp, r)
+				require.NoError(t, b.Err())
+				// Nothing is fetched twice.
+				require.LessOrEqual(t, b.Stats().FetchedBytes, int64(b.Len()))
+			}
+		})
+	}
+}
+
+// BenchmarkObjectStoreQueries measures the requests and bytes fetched from an
+// object store to get the postings of every query of the workload, with
+// readers started from index headers.
+func BenchmarkObjectStoreQueries(b *testing.B) {
+	queries := loadBenchQueries(b)
+	for _, idx := range memoryIndexes {
+		r, err := NewFileReaderWithOptions(idx.path, ReaderOptions{PostingsCodec: idx.codec})
+		require.NoError(b, err)
+		header := writeHeader(b, r)
+		size := r.Size()
+		require.NoError(b, r.Close())
+		store := objectStores(b, filepath.Dir(idx.path))["http"]
+
+		for _, pageSize := range []int{1 << 10, DefaultObjectPageSize} {
+			for i, q := range queries {
+				b.Run(fmt.Sprintf("%s/page=%d/query=%d", idx.codec.Name(), pageSize, i+1), func(b *testing.B) {
+					var stats ObjectReadStats
+					for n := 0; n < b.N; n++ {
+						bs, err := NewObjectByteSlice(context.Background(), store, filepath.Base(idx.path), ObjectByteSliceOptions{Size: size, PageSize: pageSize})
+						require.NoError(b, err)
+						r, err := NewReaderFromHeader(realByteSlice(header), bs, ReaderOptions{PostingsCodec: idx.codec})
+						require.NoError(b, err)
+						p, err := PostingsForMatchers(r, q.Matchers...)
+						require.NoError(b, err)
+						_, err = ExpandPostings(p)
+						require.NoError(b, err)
+						require.NoError(b, bs.Err())
+
+						s := bs.Stats()
+						stats.Requests += s.Requests
+						stats.FetchedBytes += s.FetchedBytes
+						stats.RangeBytes += s.RangeBytes
+					}
+					b.ReportMetric(float64(stats.Requests)/float64(b.N), "requests/op")
+					b.ReportMetric(float64(stats.FetchedBytes)/float64(b.N), "fetched-B/op")
+					b.ReportMetric(float64(stats.RangeBytes)/float64(b.N), "read-B/op")
+				})
+			}
+		}
+	}
+}
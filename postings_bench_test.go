@@ -1,14 +1,11 @@
 package main
 
 import (
-	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
-	"os"
 	"testing"
 
-	"github.com/go-kit/log"
 	"github.com/stretchr/testify/require"
 
 	h_labels "github.com/Harkishen-Singh/prometheus/model/labels"
@@ -16,11 +13,6 @@ import (
 
 	h_storage "github.com/Harkishen-Singh/prometheus/storage"
 	p_storage "github.com/prometheus/prometheus/storage"
-
-	rb_tsdb "github.com/Harkishen-Singh/prometheus/tsdb"
-	rb_chunkenc "github.com/Harkishen-Singh/prometheus/tsdb/chunkenc"
-	be_tsdb "github.com/prometheus/prometheus/tsdb"
-	be_chunkenc "github.com/prometheus/prometheus/tsdb/chunkenc"
 )
 
 func generateSeriesIds(start, end, incr int) []uint32 {
@@ -238,43 +230,6 @@ func getBigEndianPostings(ids []uint32) *bigEndianPostings {
 //	require.Equal(b, numBigEndian, numRoaring)
 //}
 
-const be_blockpath = "data/be_block"
-const rb_blockpath = "data/rb_block"
-
-func ConvertBigEndianBlockToRoaringBitmapBLock(t *testing.T) {
-	block, err := be_tsdb.OpenBlock(log.NewLogfmtLogger(os.Stdout), be_blockpath, be_chunkenc.NewPool())
-	querier, err := be_tsdb.NewBlockQuerier(block, 0, 1641945600000)
-	require.NoError(t, err)
-
-	matcher := p_labels.MustNewMatcher(p_labels.MatchRegexp, "__name__", ".+")
-	seriesSet := querier.Select(false, &p_storage.SelectHints{
-		Start: 0,
-		End:   1641945600000,
-		Step:  1,
-	}, matcher)
-
-	blockWriter, err := rb_tsdb.NewBlockWriter(log.NewLogfmtLogger(os.Stdout), rb_blockpath, 100*1024*1024*1024)
-	require.NoError(t, err)
-	defer blockWriter.Close()
-
-	for seriesSet.Next() {
-		serie := seriesSet.At()
-		lbls := serie.Labels()
-		itr := serie.Iterator()
-		seriesAppender := blockWriter.Appender(context.Background())
-		cl := convertLabels(lbls)
-		for itr.Next() {
-			ts, v := itr.At()
-			_, err = seriesAppender.Append(0, cl, ts, v)
-			require.NoError(t, err)
-		}
-		require.NoError(t, seriesAppender.Commit())
-	}
-	ulid, err := blockWriter.Flush(context.Background())
-	require.NoError(t, err)
-	fmt.Println("roaring bitmap index block ulid", ulid)
-}
-
 func convertLabels(p p_labels.Labels) h_labels.Labels {
 	hLabels := []h_labels.Label{}
 	for i := range p {
@@ -287,90 +242,37 @@ func convertLabels(p p_labels.Labels) h_labels.Labels {
 	return hLabels
 }
 
-type benchQueries struct {
-	id        int
-	pmatchers []*p_labels.Matcher
-	hmatchers []*h_labels.Matcher
-}
+// benchWorkloadPath holds the selectors of the query benchmarks.
+const benchWorkloadPath = "data/queries.workload"
 
-var queries = []benchQueries{
-	{
-		id: 1,
-		pmatchers: []*p_labels.Matcher{
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "job", "prometheus"),
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "__name__", "go_goroutines"),
-		},
-		hmatchers: []*h_labels.Matcher{
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "job", "prometheus"),
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "__name__", "go_goroutines"),
-		},
-	}, {
-		id: 2,
-		pmatchers: []*p_labels.Matcher{
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "pod", "alertmanager-main-2"),
-			p_labels.MustNewMatcher(p_labels.MatchNotEqual, "__name__", "go_goroutines"),
-		},
-		hmatchers: []*h_labels.Matcher{
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "pod", "alertmanager-main-2"),
-			h_labels.MustNewMatcher(h_labels.MatchNotEqual, "__name__", "go_goroutines"),
-		},
-	}, {
-		id: 3,
-		pmatchers: []*p_labels.Matcher{
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "__name__", "go_gc_duration_seconds"),
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "job", "demo"),
-		},
-		hmatchers: []*h_labels.Matcher{
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "__name__", "go_gc_duration_seconds"),
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "job", "demo"),
-		},
-	}, {
-		id: 4,
-		pmatchers: []*p_labels.Matcher{
-			p_labels.MustNewMatcher(p_labels.MatchRegexp, "instance", "10.42.*"),
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "service", "alertmanager-main"),
-			p_labels.MustNewMatcher(p_labels.MatchEqual, "endpoint", "reloader-web"),
-		},
-		hmatchers: []*h_labels.Matcher{
-			h_labels.MustNewMatcher(h_labels.MatchRegexp, "instance", "10.42.*"),
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "service", "alertmanager-main"),
-			h_labels.MustNewMatcher(h_labels.MatchEqual, "endpoint", "reloader-web"),
-		},
-	},
+func loadBenchQueries(tb testing.TB) []WorkloadQuery {
+	queries, err := LoadWorkloadFile(benchWorkloadPath)
+	require.NoError(tb, err)
+	return queries
 }
 
 func BenchmarkPromQLQueries(b *testing.B) {
-	// BigEndian block.
-	be_block_path := "data/be_block_copy"
-	be_block, err := be_tsdb.OpenBlock(log.NewLogfmtLogger(os.Stdout), be_block_path, be_chunkenc.NewPool())
-	require.NoError(b, err)
-
-	be_querier, err := be_tsdb.NewBlockQuerier(be_block, 0, 1641945600000)
-	require.NoError(b, err)
-
-	// Bitmap block.
-	rb_block_path := "data/rb_block_copy/01FTR26BGTB9SDS8W56N8HZGGG"
-	rb_block, err := rb_tsdb.OpenBlock(log.NewLogfmtLogger(os.Stdout), rb_block_path, rb_chunkenc.NewPool())
-	require.NoError(b, err)
-
-	rb_querier, err := rb_tsdb.NewBlockQuerier(rb_block, 0, 1641945600000)
-	require.NoError(b, err)
+	be_querier, rb_querier := openFixtureQueriers(b, bigEndianBlockPath, roaringBitmapBlockPath)
 
 	var be_series_set p_storage.SeriesSet
 	var rb_series_set h_storage.SeriesSet
 
+	queries := loadBenchQueries(b)
 	for i := range queries {
-		b.Run(fmt.Sprintf("big_endian_%d", queries[i].id), func(b *testing.B) {
-			be_series_set = be_querier.Select(false, nil, queries[i].pmatchers...)
+		b.Run(fmt.Sprintf("big_endian_%d", i+1), func(b *testing.B) {
+			be_series_set = be_querier.Select(false, nil, queries[i].Matchers...)
 		})
-		b.Run(fmt.Sprintf("roaring_bitmap_%d", queries[i].id), func(b *testing.B) {
-			rb_series_set = rb_querier.Select(false, nil, queries[i].hmatchers...)
+		b.Run(fmt.Sprintf("roaring_bitmap_%d", i+1), func(b *testing.B) {
+			rb_series_set = rb_querier.Select(false, nil, queries[i].ForkMatchers...)
 		})
 		compareSeriesSet(b, be_series_set, rb_series_set)
 	}
 }
 
-func compareSeriesSet(b *testing.B, be_series_set p_storage.SeriesSet, rb_series_set h_storage.SeriesSet) {
+// compareSeriesSet checks that both sets hold the same series and samples, and
+// returns the number of series.
+func compareSeriesSet(b testing.TB, be_series_set p_storage.SeriesSet, rb_series_set h_storage.SeriesSet) int {
+	n := 0
 	for {
 		containsBE := be_series_set.Next()
 		containsRB := rb_series_set.Next()
@@ -378,6 +280,7 @@ func compareSeriesSet(b *testing.B, be_series_set p_storage.SeriesSet, rb_series
 		if !containsRB || !containsBE {
 			break
 		}
+		n++
 
 		require.NoError(b, be_series_set.Err())
 		require.NoError(b, rb_series_set.Err())
@@ -410,4 +313,5 @@ func compareSeriesSet(b *testing.B, be_series_set p_storage.SeriesSet, rb_series
 			require.EqualValues(b, vBE, vRB)
 		}
 	}
+	return n
 }
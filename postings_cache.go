@@ -0,0 +1,383 @@
+package main
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+)
+
+// PostingsCache caches encoded postings lists of index blocks.
+type PostingsCache interface {
+	// StorePostings stores the encoded postings list of a label pair of a block.
+	StorePostings(block string, l labels.Label, v []byte)
+
+	// FetchPostings returns the encoded postings list of a label pair of a block
+	// if it is cached.
+	FetchPostings(block string, l labels.Label) ([]byte, bool)
+}
+
+// PostingsCacheStats holds the counters of a postings cache.
+type PostingsCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Items and Bytes describe what is currently cached.
+	Items int
+	Bytes uint64
+}
+
+// HitRatio returns the share of fetches that were served from the cache.
+func (s PostingsCacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+type postingsCacheKey struct {
+	block, name, value string
+	// Normalized matchers of expanded postings, empty for label pairs.
+	matchers string
+}
+
+type postingsCacheEntry struct {
+	key postingsCacheKey
+	v   []byte
+}
+
+// postingsCacheEntryOverhead approximates the memory used by an entry beyond
+// its key and value bytes, for the map, list element and headers.
+const postingsCacheEntryOverhead = 160
+
+func entrySize(key postingsCacheKey, v []byte) uint64 {
+	return uint64(len(key.block)+len(key.name)+len(key.value)+len(key.matchers)+cap(v)) + postingsCacheEntryOverhead
+}
+
+// lruCache holds byte values up to a size limit, evicting the least recently
+// used ones first.
+type lruCache struct {
+	mtx      sync.Mutex
+	maxBytes uint64
+	items    map[postingsCacheKey]*list.Element
+	lru      *list.List // Most recently used first.
+	stats    PostingsCacheStats
+}
+
+func newLRUCache(maxBytes uint64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		items:    map[postingsCacheKey]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// store adds v under key, which must not reference memory that may change.
+// Values larger than the whole cache are not stored.
+func (c *lruCache) store(key postingsCacheKey, v []byte) {
+	size := entrySize(key, v)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+	for c.stats.Bytes+size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.items[key] = c.lru.PushFront(&postingsCacheEntry{key: key, v: v})
+	c.stats.Items++
+	c.stats.Bytes += size
+}
+
+func (c *lruCache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*postingsCacheEntry)
+	delete(c.items, entry.key)
+	c.stats.Items--
+	c.stats.Bytes -= entrySize(entry.key, entry.v)
+}
+
+func (c *lruCache) fetch(key postingsCacheKey) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*postingsCacheEntry).v, true
+}
+
+// Stats returns the current counters of the cache.
+func (c *lruCache) Stats() PostingsCacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stats
+}
+
+// LRUPostingsCache is a PostingsCache that evicts the least recently used
+// postings lists once its entries exceed a size limit in bytes.
+type LRUPostingsCache struct {
+	*lruCache
+}
+
+// NewLRUPostingsCache returns a postings cache holding up to maxBytes.
+func NewLRUPostingsCache(maxBytes uint64) *LRUPostingsCache {
+	return &LRUPostingsCache{lruCache: newLRUCache(maxBytes)}
+}
+
+// StorePostings implements PostingsCache. The cache keeps v, which must not
+// be modified afterwards. Lists larger than the whole cache are not stored.
+func (c *LRUPostingsCache) StorePostings(block string, l labels.Label, v []byte) {
+	// The label strings may point into an mmapped index, so copy them.
+	c.store(postingsCacheKey{
+		block: string([]byte(block)),
+		name:  string([]byte(l.Name)),
+		value: string([]byte(l.Value)),
+	}, v)
+}
+
+// FetchPostings implements PostingsCache.
+func (c *LRUPostingsCache) FetchPostings(block string, l labels.Label) ([]byte, bool) {
+	return c.fetch(postingsCacheKey{block: block, name: l.Name, value: l.Value})
+}
+
+// CachingReader serves the postings of a Reader through a PostingsCache.
+type CachingReader struct {
+	*Reader
+
+	block string
+	cache PostingsCache
+	// Codec the postings lists are stored in the cache with.
+	codec PostingsCodec
+}
+
+// NewCachingReader returns a CachingReader for the postings of the index
+// block identified by block. Cached postings lists are stored with codec,
+// transcoding them if it is not the codec of the index.
+func NewCachingReader(r *Reader, block string, cache PostingsCache, codec PostingsCodec) *CachingReader {
+	return &CachingReader{
+		Reader: r,
+		block:  block,
+		cache:  cache,
+		codec:  codec,
+	}
+}
+
+// Postings returns the postings list for the given label name and sorted
+// values, fetching each value's list from the cache if it is present. Values
+// that are not in the index are cached with an empty list, so that looking
+// them up again does not read the postings offset table.
+func (r *CachingReader) Postings(name string, values ...string) (Postings, error) {
+	res := make([]Postings, 0, len(values))
+	var misses []string
+	for _, v := range values {
+		b, ok := r.cache.FetchPostings(r.block, labels.Label{Name: name, Value: v})
+		if !ok {
+			misses = append(misses, v)
+			continue
+		}
+		_, p, err := r.codec.DecodePostings(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode cached postings")
+		}
+		res = append(res, p)
+	}
+
+	if len(misses) == 0 {
+		return Merge(res...), nil
+	}
+	found := make(map[string]struct{}, len(misses))
+	if err := r.postingsLists(name, misses, func(value string, b []byte) error {
+		found[value] = struct{}{}
+		v, err := r.cacheValue(b)
+		if err != nil {
+			return err
+		}
+		r.cache.StorePostings(r.block, labels.Label{Name: name, Value: value}, v)
+
+		_, p, err := r.codec.DecodePostings(v)
+		if err != nil {
+			return errors.Wrap(err, "decode postings")
+		}
+		res = append(res, p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var empty []byte
+	for _, v := range misses {
+		if _, ok := found[v]; ok {
+			continue
+		}
+		if empty == nil {
+			var e encoding.Encbuf
+			if err := r.codec.EncodePostings(&e, nil); err != nil {
+				return nil, errors.Wrap(err, "encode postings")
+			}
+			empty = alignedCopy(e.Get())
+		}
+		r.cache.StorePostings(r.block, labels.Label{Name: name, Value: v}, empty)
+	}
+	return Merge(res...), nil
+}
+
+// cacheValue returns the postings list payload b, as read from the index, in
+// the codec of the cache. The result is detached from the index bytes.
+func (r *CachingReader) cacheValue(b []byte) ([]byte, error) {
+	if r.codec == r.dec.Codec {
+		return alignedCopy(b), nil
+	}
+	_, p, err := r.dec.Postings(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode postings")
+	}
+	var offs []uint64
+	for p.Next() {
+		offs = append(offs, uint64(p.At()))
+	}
+	if p.Err() != nil {
+		return nil, p.Err()
+	}
+	var e encoding.Encbuf
+	if err := r.codec.EncodePostings(&e, offs); err != nil {
+		return nil, errors.Wrap(err, "encode postings")
+	}
+	return alignedCopy(e.Get()), nil
+}
+
+// alignedCopy copies a postings list payload so that it keeps the alignment
+// it has in the index, where it follows a 4 byte length. Roaring bitmaps can
+// then be used in place.
+func alignedCopy(b []byte) []byte {
+	c := make([]byte, 4+len(b))
+	copy(c[4:], b)
+	return c[4:]
+}
+
+// ExpandedPostingsCache caches the postings matching sets of label matchers.
+type ExpandedPostingsCache interface {
+	// StoreExpandedPostings stores the encoded postings matching the
+	// normalized matchers key of a block.
+	StoreExpandedPostings(block string, key string, v []byte)
+
+	// FetchExpandedPostings returns the encoded postings matching the
+	// normalized matchers key of a block if they are cached.
+	FetchExpandedPostings(block string, key string) ([]byte, bool)
+}
+
+// LRUExpandedPostingsCache is an ExpandedPostingsCache that evicts the least
+// recently used results once its entries exceed a size limit in bytes.
+type LRUExpandedPostingsCache struct {
+	*lruCache
+}
+
+// NewLRUExpandedPostingsCache returns an expanded postings cache holding up
+// to maxBytes.
+func NewLRUExpandedPostingsCache(maxBytes uint64) *LRUExpandedPostingsCache {
+	return &LRUExpandedPostingsCache{lruCache: newLRUCache(maxBytes)}
+}
+
+// StoreExpandedPostings implements ExpandedPostingsCache. The cache keeps v,
+// which must not be modified afterwards.
+func (c *LRUExpandedPostingsCache) StoreExpandedPostings(block string, key string, v []byte) {
+	c.store(postingsCacheKey{block: string([]byte(block)), matchers: key}, v)
+}
+
+// FetchExpandedPostings implements ExpandedPostingsCache.
+func (c *LRUExpandedPostingsCache) FetchExpandedPostings(block string, key string) ([]byte, bool) {
+	return c.fetch(postingsCacheKey{block: block, matchers: key})
+}
+
+// MatchersKey returns a key for the set of matchers that does not depend on
+// their order or on duplicates.
+func MatchersKey(ms ...*labels.Matcher) string {
+	strs := make([]string, 0, len(ms))
+	for _, m := range ms {
+		strs = append(strs, m.String())
+	}
+	// Matcher strings start with the label name, and quote the value.
+	sort.Strings(strs)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, s := range strs {
+		if i > 0 && s == strs[i-1] {
+			continue
+		}
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(s)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// ExpandedPostingsReader evaluates label matchers over an index, caching the
+// resulting postings as roaring bitmaps.
+type ExpandedPostingsReader struct {
+	ix    IndexPostingsReader
+	block string
+	cache ExpandedPostingsCache
+}
+
+// NewExpandedPostingsReader returns an ExpandedPostingsReader for the index
+// block identified by block.
+func NewExpandedPostingsReader(ix IndexPostingsReader, block string, cache ExpandedPostingsCache) *ExpandedPostingsReader {
+	return &ExpandedPostingsReader{
+		ix:    ix,
+		block: block,
+		cache: cache,
+	}
+}
+
+// PostingsForMatchers returns the postings of the series matching all
+// matchers, as PostingsForMatchers does, from the cache if they are present.
+func (r *ExpandedPostingsReader) PostingsForMatchers(ms ...*labels.Matcher) (Postings, error) {
+	key := MatchersKey(ms...)
+	if b, ok := r.cache.FetchExpandedPostings(r.block, key); ok {
+		_, p, err := RoaringPostingsCodec.DecodePostings(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "decode cached postings")
+		}
+		return p, nil
+	}
+
+	p, err := PostingsForMatchers(r.ix, ms...)
+	if err != nil {
+		return nil, err
+	}
+	var offs []uint64
+	for p.Next() {
+		offs = append(offs, uint64(p.At()))
+	}
+	if p.Err() != nil {
+		return nil, errors.Wrap(p.Err(), "expand postings")
+	}
+	var e encoding.Encbuf
+	if err := RoaringPostingsCodec.EncodePostings(&e, offs); err != nil {
+		return nil, errors.Wrap(err, "encode postings")
+	}
+	v := alignedCopy(e.Get())
+	r.cache.StoreExpandedPostings(r.block, key, v)
+
+	_, p, err = RoaringPostingsCodec.DecodePostings(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode postings")
+	}
+	return p, nil
+}
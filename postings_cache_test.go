@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUPostingsCache(t *testing.T) {
+	l := func(v string) labels.Label { return labels.Label{Name: "n", Value: v} }
+	size := entrySize(postingsCacheKey{block: "b", name: "n", value: "1"}, make([]byte, 100))
+
+	c := NewLRUPostingsCache(2 * size)
+	c.StorePostings("b", l("1"), make([]byte, 100))
+	c.StorePostings("b", l("2"), make([]byte, 100))
+	_, ok := c.FetchPostings("b", l("1"))
+	require.True(t, ok)
+
+	// Storing a third list evicts the least recently used one.
+	c.StorePostings("b", l("3"), make([]byte, 100))
+	_, ok = c.FetchPostings("b", l("2"))
+	require.False(t, ok)
+	_, ok = c.FetchPostings("b", l("1"))
+	require.True(t, ok)
+	_, ok = c.FetchPostings("other", l("1"))
+	require.False(t, ok)
+
+	// Lists larger than the cache are not stored and evict nothing.
+	c.StorePostings("b", l("4"), make([]byte, 3*size))
+	_, ok = c.FetchPostings("b", l("4"))
+	require.False(t, ok)
+
+	require.Equal(t, PostingsCacheStats{
+		Hits:      2,
+		Misses:    3,
+		Evictions: 1,
+		Items:     2,
+		Bytes:     2 * size,
+	}, c.Stats())
+}
+
+func TestCachingReader(t *testing.T) {
+	rbPath := filepath.Join(t.TempDir(), "index")
+	rewriteIndex(t, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(t, err)
+		defer ir.Close()
+
+		values, err := ir.LabelValues("job")
+		require.NoError(t, err)
+		values = append(values, "missing")
+
+		for _, stored := range []PostingsCodec{BigEndianPostingsCodec, RoaringPostingsCodec} {
+			t.Run(fmt.Sprintf("%s/%s", c.codec.Name(), stored.Name()), func(t *testing.T) {
+				cache := NewLRUPostingsCache(1 << 30)
+				cr := NewCachingReader(ir, "block", cache, stored)
+
+				p, err := ir.Postings("job", values...)
+				require.NoError(t, err)
+				exp, err := ExpandPostings(p)
+				require.NoError(t, err)
+
+				// The first lookup fills the cache, the second is served from it.
+				for i := 0; i < 2; i++ {
+					p, err := cr.Postings("job", values...)
+					require.NoError(t, err)
+					got, err := ExpandPostings(p)
+					require.NoError(t, err)
+					require.Equal(t, exp, got)
+				}
+				// Missing values are cached with an empty list.
+				stats := cache.Stats()
+				require.Equal(t, len(values), stats.Items)
+				require.Equal(t, uint64(len(values)), stats.Hits)
+				require.Equal(t, uint64(len(values)), stats.Misses)
+
+				b, ok := cache.FetchPostings("block", labels.Label{Name: "job", Value: "missing"})
+				require.True(t, ok)
+				_, p, err = stored.DecodePostings(b)
+				require.NoError(t, err)
+				got, err := ExpandPostings(p)
+				require.NoError(t, err)
+				require.Empty(t, got)
+			})
+		}
+	}
+}
+
+func BenchmarkCachingReader(b *testing.B) {
+	rbPath := filepath.Join(b.TempDir(), "index")
+	rewriteIndex(b, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	jobs := []string{"demo", "prometheus", "promscale", "robust"}
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(b, err)
+		defer ir.Close()
+
+		// Compare reading postings from the index with fetching them from a
+		// cache storing the index encoding or roaring bitmaps, to weigh decode
+		// cost against set operation cost.
+		for _, stored := range []PostingsCodec{nil, BigEndianPostingsCodec, RoaringPostingsCodec} {
+			var (
+				cache  *LRUPostingsCache
+				name   = "uncached"
+				lookup = ir.Postings
+			)
+			if stored != nil {
+				cache = NewLRUPostingsCache(1 << 30)
+				lookup = NewCachingReader(ir, "block", cache, stored).Postings
+				name = fmt.Sprintf("cached_%s", stored.Name())
+			}
+			postings := func() []Postings {
+				ps := make([]Postings, 0, len(jobs))
+				for _, job := range jobs {
+					p, err := lookup("job", job)
+					require.NoError(b, err)
+					ps = append(ps, p)
+				}
+				return ps
+			}
+			reportHitRatio := func(b *testing.B) {
+				if cache != nil {
+					b.ReportMetric(cache.Stats().HitRatio(), "hit-ratio")
+				}
+			}
+
+			b.Run(fmt.Sprintf("%s/%s/intersect", c.codec.Name(), name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, err := ExpandPostings(Intersect(postings()...))
+					require.NoError(b, err)
+				}
+				reportHitRatio(b)
+			})
+			b.Run(fmt.Sprintf("%s/%s/union", c.codec.Name(), name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, err := ExpandPostings(Merge(postings()...))
+					require.NoError(b, err)
+				}
+				reportHitRatio(b)
+			})
+		}
+	}
+}
+
+func TestMatchersKey(t *testing.T) {
+	a := labels.MustNewMatcher(labels.MatchEqual, "job", "demo")
+	b := labels.MustNewMatcher(labels.MatchNotRegexp, "__name__", "go_.*")
+	c := labels.MustNewMatcher(labels.MatchEqual, "job", "prometheus")
+
+	require.Equal(t, `{__name__!~"go_.*",job="demo"}`, MatchersKey(a, b))
+	require.Equal(t, MatchersKey(a, b), MatchersKey(b, a, b))
+	require.NotEqual(t, MatchersKey(a, b), MatchersKey(c, b))
+	require.Equal(t, "{}", MatchersKey())
+}
+
+func TestExpandedPostingsReader(t *testing.T) {
+	rbPath := filepath.Join(t.TempDir(), "index")
+	rewriteIndex(t, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		t.Run(c.codec.Name(), func(t *testing.T) {
+			ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+			require.NoError(t, err)
+			defer ir.Close()
+
+			cache := NewLRUExpandedPostingsCache(1 << 30)
+			er := NewExpandedPostingsReader(ir, "block", cache)
+			for _, ms := range testMatcherSets {
+				p, err := PostingsForMatchers(ir, ms...)
+				require.NoError(t, err)
+				exp, err := ExpandPostings(p)
+				require.NoError(t, err)
+
+				// The first lookup fills the cache, the second is served from it.
+				for i := 0; i < 2; i++ {
+					p, err := er.PostingsForMatchers(ms...)
+					require.NoError(t, err)
+					got, err := ExpandPostings(p)
+					require.NoError(t, err)
+					require.Equal(t, exp, got, "postings for %s", MatchersKey(ms...))
+				}
+			}
+			stats := cache.Stats()
+			require.Equal(t, len(testMatcherSets), stats.Items)
+			require.Equal(t, uint64(len(testMatcherSets)), stats.Hits)
+			require.Equal(t, uint64(len(testMatcherSets)), stats.Misses)
+		})
+	}
+}
+
+func BenchmarkExpandedPostingsReader(b *testing.B) {
+	rbPath := filepath.Join(b.TempDir(), "index")
+	rewriteIndex(b, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	// The selectors of the query benchmarks, plus some broader ones that match
+	// enough series for the cached representation to matter.
+	var matcherSets [][]*labels.Matcher
+	for _, q := range loadBenchQueries(b) {
+		matcherSets = append(matcherSets, q.Matchers)
+	}
+	matcherSets = append(matcherSets, testMatcherSets...)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(b, err)
+		defer ir.Close()
+
+		b.Run(fmt.Sprintf("%s/uncached", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, ms := range matcherSets {
+					p, err := PostingsForMatchers(ir, ms...)
+					require.NoError(b, err)
+					_, err = ExpandPostings(p)
+					require.NoError(b, err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%s/cached", c.codec.Name()), func(b *testing.B) {
+			cache := NewLRUExpandedPostingsCache(1 << 30)
+			er := NewExpandedPostingsReader(ir, "block", cache)
+			var refs int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				refs = 0
+				for _, ms := range matcherSets {
+					p, err := er.PostingsForMatchers(ms...)
+					require.NoError(b, err)
+					l, err := ExpandPostings(p)
+					require.NoError(b, err)
+					refs += len(l)
+				}
+			}
+			stats := cache.Stats()
+			b.ReportMetric(stats.HitRatio(), "hit-ratio")
+			b.ReportMetric(float64(stats.Bytes), "cache-bytes")
+			// What caching the results as []storage.SeriesRef would take.
+			b.ReportMetric(float64(refs*8+stats.Items*postingsCacheEntryOverhead), "slice-bytes")
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalesceRanges(t *testing.T) {
+	for _, c := range []struct {
+		ranges []Range
+		maxGap int64
+		exp    []Range
+	}{
+		{ranges: nil, maxGap: 10, exp: nil},
+		{ranges: []Range{{Start: 0, End: 10}}, maxGap: 0, exp: []Range{{Start: 0, End: 10}}},
+		// Adjacent ranges are merged, also out of order.
+		{
+			ranges: []Range{{Start: 10, End: 20}, {Start: 0, End: 10}},
+			maxGap: 0,
+			exp:    []Range{{Start: 0, End: 20}},
+		},
+		{
+			ranges: []Range{{Start: 0, End: 10}, {Start: 15, End: 20}, {Start: 30, End: 40}},
+			maxGap: 5,
+			exp:    []Range{{Start: 0, End: 20}, {Start: 30, End: 40}},
+		},
+		{
+			ranges: []Range{{Start: 0, End: 10}, {Start: 15, End: 20}, {Start: 30, End: 40}},
+			maxGap: 4,
+			exp:    []Range{{Start: 0, End: 10}, {Start: 15, End: 20}, {Start: 30, End: 40}},
+		},
+		// Overlapping and contained ranges.
+		{
+			ranges: []Range{{Start: 0, End: 30}, {Start: 5, End: 10}, {Start: 20, End: 35}},
+			maxGap: 0,
+			exp:    []Range{{Start: 0, End: 35}},
+		},
+		{
+			ranges: []Range{{Start: 0, End: 10}, {Start: 20, End: 30}, {Start: 40, End: 50}},
+			maxGap: math.MaxInt64 - 50,
+			exp:    []Range{{Start: 0, End: 50}},
+		},
+	} {
+		require.Equal(t, c.exp, CoalesceRanges(c.ranges, c.maxGap), "%v by %d", c.ranges, c.maxGap)
+	}
+}
+
+// allLabelPairs returns every label pair of the index read by r, with the one
+// of the list of all series.
+func allLabelPairs(tb testing.TB, r *Reader) []labels.Label {
+	name, value := AllPostingsKey()
+	pairs := []labels.Label{{Name: name, Value: value}}
+	names, err := r.LabelNames()
+	require.NoError(tb, err)
+	for _, name := range names {
+		values, err := r.SortedLabelValues(name)
+		require.NoError(tb, err)
+		for _, v := range values {
+			pairs = append(pairs, labels.Label{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
+
+// requireFetchedPostings requires that the postings fetched for the pairs are
+// the ones of Postings.
+func requireFetchedPostings(tb testing.TB, r *Reader, pairs []labels.Label, got []Postings) {
+	require.Len(tb, got, len(pairs))
+	for i, l := range pairs {
+		p, err := r.Postings(l.Name, l.Value)
+		require.NoError(tb, err)
+		exp, err := ExpandPostings(p)
+		require.NoError(tb, err)
+		refs, err := ExpandPostings(got[i])
+		require.NoError(tb, err)
+		require.Equal(tb, exp, refs, "%s", l)
+	}
+}
+
+func TestFetchPostings(t *testing.T) {
+	series := generateIndexSeries(9, 1000)
+	path := filepath.Join(t.TempDir(), "index")
+	writeIndex(t, path, BigEndian64PostingsCodec, indexSymbols(series), series)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: roaringBitmapIndexPath, codec: RoaringPostingsCodec},
+		{path: path, codec: BigEndian64PostingsCodec},
+	} {
+		b, err := ioutil.ReadFile(c.path)
+		require.NoError(t, err)
+
+		for _, factor := range []int{1, 2, DefaultPostingsOffsetsFactor} {
+			r, err := NewReaderWithOptions(realByteSlice(b), ReaderOptions{PostingsCodec: c.codec, PostingsOffsetsFactor: factor})
+			require.NoError(t, err)
+			all := allLabelPairs(t, r)
+
+			rnd := rand.New(rand.NewSource(int64(factor)))
+			subset := []labels.Label{{Name: "missing", Value: "value"}, all[len(all)-1], all[0]}
+			for _, i := range rnd.Perm(len(all))[:len(all)/10] {
+				subset = append(subset, all[i], labels.Label{Name: all[i].Name, Value: all[i].Value + "\x00"})
+			}
+			subset = append(subset, subset[1:5]...)
+
+			for _, pairs := range [][]labels.Label{all, subset, {}} {
+				for _, maxGap := range []int{-1, 0, 100, DefaultPostingsFetchGap, math.MaxInt32} {
+					t.Run(fmt.Sprintf("%s/factor=%d/pairs=%d/gap=%d", c.path, factor, len(pairs), maxGap), func(t *testing.T) {
+						index := &countingByteSlice{ByteSlice: realByteSlice(b)}
+						r.b = index
+						got, stats, err := r.FetchPostings(pairs, maxGap)
+						r.b = realByteSlice(b)
+						require.NoError(t, err)
+						requireFetchedPostings(t, r, pairs, got)
+
+						require.LessOrEqual(t, stats.Ranges, stats.Lists)
+						require.LessOrEqual(t, stats.ListBytes, stats.FetchedBytes)
+						if maxGap == math.MaxInt32 {
+							require.Equal(t, minInt(stats.Lists, 1), stats.Ranges)
+						}
+						// Lists are read once per merged range, on top of
+						// the entries of the postings offset table.
+						require.GreaterOrEqual(t, index.reads, stats.Ranges)
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestFetchPostingsRanges(t *testing.T) {
+	for _, idx := range memoryIndexes {
+		r, err := NewFileReaderWithOptions(idx.path, ReaderOptions{PostingsCodec: idx.codec})
+		require.NoError(t, err)
+		defer r.Close()
+		all := allLabelPairs(t, r)
+		ranges, err := r.PostingsRanges()
+		require.NoError(t, err)
+
+		// Every list takes its own range, which holds the list and its
+		// checksum, and padding up to the next one.
+		got, stats, err := r.FetchPostings(all, -1)
+		require.NoError(t, err)
+		requireFetchedPostings(t, r, all, got)
+		require.Equal(t, len(all), stats.Lists)
+		require.Equal(t, len(all), stats.Ranges)
+		var listBytes int64
+		for _, rng := range ranges {
+			listBytes += rng.End - rng.Start + 8
+		}
+		require.LessOrEqual(t, listBytes, stats.ListBytes)
+		require.Less(t, stats.ListBytes-listBytes, int64(len(all)*idx.codec.Alignment()))
+	}
+}
+
+func TestFetchPostingsCorruption(t *testing.T) {
+	b, err := ioutil.ReadFile(bigEndianIndexPath)
+	require.NoError(t, err)
+	r, err := NewReader(realByteSlice(b))
+	require.NoError(t, err)
+	ranges, err := r.PostingsRanges()
+	require.NoError(t, err)
+	all := allLabelPairs(t, r)
+
+	// Flipped bytes of lists fail their checksums.
+	for _, l := range []labels.Label{all[0], all[len(all)/2], all[len(all)-1]} {
+		corrupted := append([]byte(nil), b...)
+		corrupted[ranges[l].Start] ^= 0x01
+		r, err := NewReader(realByteSlice(corrupted))
+		require.NoError(t, err)
+		_, _, err = r.FetchPostings([]labels.Label{l}, DefaultPostingsFetchGap)
+		require.Error(t, err, "%s", l)
+	}
+
+	v1, err := NewReader(realByteSlice(b))
+	require.NoError(t, err)
+	v1.version = FormatV1
+	v1.postingsV1 = map[string]map[string]uint64{}
+	got, stats, err := v1.FetchPostings([]labels.Label{{Name: "a", Value: "b"}}, DefaultPostingsFetchGap)
+	require.NoError(t, err)
+	require.Equal(t, []Postings{EmptyPostings()}, got)
+	require.Zero(t, stats.Lists)
+}
+
+func TestFetchPostingsFromObjectStore(t *testing.T) {
+	for _, idx := range memoryIndexes {
+		t.Run(idx.codec.Name(), func(t *testing.T) {
+			exp, err := NewFileReaderWithOptions(idx.path, ReaderOptions{PostingsCodec: idx.codec})
+			require.NoError(t, err)
+			defer exp.Close()
+			header := writeHeader(t, exp)
+			all := allLabelPairs(t, exp)
+			store := FileObjectStore{Dir: filepath.Dir(idx.path)}
+
+			open := func() (*Reader, *ObjectByteSlice) {
+				b, err := NewObjectByteSlice(context.Background(), store, filepath.Base(idx.path), ObjectByteSliceOptions{PageSize: 1024})
+				require.NoError(t, err)
+				r, err := NewReaderFromHeader(realByteSlice(header), b, ReaderOptions{PostingsCodec: idx.codec})
+				require.NoError(t, err)
+				return r, b
+			}
+
+			// Every tenth label pair, which leaves gaps between lists.
+			var pairs []labels.Label
+			for i := 0; i < len(all); i += 10 {
+				pairs = append(pairs, all[i])
+			}
+			r, b := open()
+			for _, l := range pairs {
+				_, err := r.Postings(l.Name, l.Value)
+				require.NoError(t, err)
+			}
+			one := b.Stats()
+
+			r, b = open()
+			got, _, err := r.FetchPostings(pairs, DefaultPostingsFetchGap)
+			require.NoError(t, err)
+			require.NoError(t, b.Err())
+			fetched := b.Stats()
+			requireFetchedPostings(t, exp, pairs, got)
+			require.Less(t, fetched.Requests, one.Requests)
+		})
+	}
+}
+
+// BenchmarkFetchPostings compares the requests to an object store and the
+// bytes fetched to get the postings lists of the label pairs selected by each
+// query of the workload one by one and with FetchPostings, with readers
+// started from index headers.
+func BenchmarkFetchPostings(b *testing.B) {
+	queries := loadBenchQueries(b)
+	for _, idx := range memoryIndexes {
+		r, err := NewFileReaderWithOptions(idx.path, ReaderOptions{PostingsCodec: idx.codec})
+		require.NoError(b, err)
+		header := writeHeader(b, r)
+		size := r.Size()
+		store := objectStores(b, filepath.Dir(idx.path))["http"]
+
+		for i, q := range queries {
+			var pairs []labels.Label
+			for _, m := range q.Matchers {
+				if m.Matches("") {
+					continue
+				}
+				values, err := r.SortedLabelValues(m.Name)
+				require.NoError(b, err)
+				for _, v := range values {
+					if !m.Matches(v) {
+						continue
+					}
+					pairs = append(pairs, labels.Label{Name: m.Name, Value: v})
+				}
+			}
+
+			for _, c := range []struct {
+				name  string
+				fetch func(r *Reader) error
+			}{
+				{name: "postings", fetch: func(r *Reader) error {
+					for _, l := range pairs {
+						p, err := r.Postings(l.Name, l.Value)
+						if err != nil {
+							return err
+						}
+						if _, err := ExpandPostings(p); err != nil {
+							return err
+						}
+					}
+					return nil
+				}},
+				{name: "fetch", fetch: func(r *Reader) error {
+					res, _, err := r.FetchPostings(pairs, DefaultPostingsFetchGap)
+					if err != nil {
+						return err
+					}
+					for _, p := range res {
+						if _, err := ExpandPostings(p); err != nil {
+							return err
+						}
+					}
+					return nil
+				}},
+			} {
+				b.Run(fmt.Sprintf("%s/query=%d/%s", idx.codec.Name(), i+1, c.name), func(b *testing.B) {
+					var stats ObjectReadStats
+					for n := 0; n < b.N; n++ {
+						bs, err := NewObjectByteSlice(context.Background(), store, filepath.Base(idx.path), ObjectByteSliceOptions{Size: size, PageSize: 1 << 10})
+						require.NoError(b, err)
+						r, err := NewReaderFromHeader(realByteSlice(header), bs, ReaderOptions{PostingsCodec: idx.codec})
+						require.NoError(b, err)
+						require.NoError(b, c.fetch(r))
+						require.NoError(b, bs.Err())
+
+						s := bs.Stats()
+						stats.Requests += s.Requests
+						stats.FetchedBytes += s.FetchedBytes
+					}
+					b.ReportMetric(float64(len(pairs)), "lists")
+					b.ReportMetric(float64(stats.Requests)/float64(b.N), "requests/op")
+					b.ReportMetric(float64(stats.FetchedBytes)/float64(b.N), "fetched-B/op")
+				})
+			}
+		}
+		require.NoError(b, r.Close())
+	}
+}
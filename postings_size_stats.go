@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+)
+
+// SizeStat holds the bytes taken by the postings lists of a label name or
+// label pair.
+type SizeStat struct {
+	Name  string
+	Bytes uint64
+	// Share is the fraction of the index size taken by the postings lists.
+	Share float64
+}
+
+// CodecSizeStats holds the sizes of postings lists written with a codec.
+type CodecSizeStats struct {
+	Codec string
+	// PostingsBytes is the size of all postings lists, including the list
+	// of all series.
+	PostingsBytes uint64
+	// IndexBytes is the size of the index with its postings lists written
+	// with the codec. It is estimated for codecs other than the one of the
+	// index, as the sizes of the other sections are assumed unchanged.
+	IndexBytes uint64
+
+	// LabelNames and LabelPairs are the largest label names and label
+	// pairs by the size of their postings lists, largest first.
+	LabelNames []SizeStat
+	LabelPairs []SizeStat
+}
+
+// PostingsSizeStats holds the sizes of the postings lists of an index under
+// several codecs.
+type PostingsSizeStats struct {
+	Codecs []CodecSizeStats
+}
+
+// postingsFrameSize returns the bytes taken in the index by a postings list
+// with a payload of n bytes, including its length, CRC32 and the padding
+// aligning the list following it to align bytes.
+func postingsFrameSize(align, n int) uint64 {
+	size := 4 + n + 4
+	if size%align != 0 {
+		size += align - size%align
+	}
+	return uint64(size)
+}
+
+// postingsAlignment returns the alignment of the postings lists of the index,
+// which is the one of its codec unless the index was written with a smaller
+// one, as roaring bitmap indexes of earlier writers were.
+func (r *Reader) postingsAlignment() (int, error) {
+	align := r.dec.Codec.Alignment()
+	if err := ReadOffsetTable(r.b, r.toc.PostingsTable, func(_ []string, off uint64, _ int) error {
+		for align > 1 && off%uint64(align) != 0 {
+			align /= 2
+		}
+		return nil
+	}); err != nil {
+		return 0, errors.Wrap(err, "read postings table")
+	}
+	return align, nil
+}
+
+// PostingsSizeStats calculates the bytes taken by the postings lists of each
+// label name and label pair when written with each of the codecs, keeping the
+// limit largest of each.
+func (r *Reader) PostingsSizeStats(codecs []PostingsCodec, limit int) (*PostingsSizeStats, error) {
+	names, err := r.LabelNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "get label names")
+	}
+	allName, allValue := AllPostingsKey()
+	indexAlign, err := r.postingsAlignment()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		totals     = make([]uint64, len(codecs))
+		labelNames = make([]*topK, len(codecs))
+		labelPairs = make([]*topK, len(codecs))
+		nameSizes  = make([]uint64, len(codecs))
+		// The size of the postings lists as they are in the index.
+		indexTotal uint64
+		refs       []uint64
+		buf        encoding.Encbuf
+	)
+	for i := range codecs {
+		labelNames[i] = newTopK(limit)
+		labelPairs[i] = newTopK(limit)
+	}
+
+	sizes := func(name, value string, b []byte) error {
+		indexTotal += postingsFrameSize(indexAlign, len(b))
+
+		refs = refs[:0]
+		_, p, err := r.dec.Postings(b)
+		if err != nil {
+			return errors.Wrapf(err, "decode postings of %s=%q", name, value)
+		}
+		for p.Next() {
+			refs = append(refs, uint64(p.At()))
+		}
+		if err := p.Err(); err != nil {
+			return errors.Wrapf(err, "iterate postings of %s=%q", name, value)
+		}
+
+		for i, codec := range codecs {
+			n, align := len(b), indexAlign
+			if codec.Name() != r.dec.Codec.Name() {
+				align = codec.Alignment()
+				buf.Reset()
+				if err := codec.EncodePostings(&buf, refs); err != nil {
+					return errors.Wrapf(err, "encode postings of %s=%q with %s", name, value, codec.Name())
+				}
+				n = buf.Len()
+			}
+			size := postingsFrameSize(align, n)
+			totals[i] += size
+			if name != allName {
+				nameSizes[i] += size
+				labelPairs[i].push(Stat{Name: name + "=" + value, Count: size})
+			}
+		}
+		return nil
+	}
+
+	if err := r.postingsLists(allName, []string{allValue}, func(value string, b []byte) error {
+		return sizes(allName, value, b)
+	}); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		values, err := r.SortedLabelValues(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get label values of %s", name)
+		}
+		for i := range nameSizes {
+			nameSizes[i] = 0
+		}
+		if err := r.postingsLists(name, values, func(value string, b []byte) error {
+			return sizes(name, value, b)
+		}); err != nil {
+			return nil, err
+		}
+		for i := range codecs {
+			labelNames[i].push(Stat{Name: name, Count: nameSizes[i]})
+		}
+	}
+
+	res := &PostingsSizeStats{Codecs: make([]CodecSizeStats, 0, len(codecs))}
+	for i, codec := range codecs {
+		indexBytes := uint64(r.Size()) - indexTotal + totals[i]
+		res.Codecs = append(res.Codecs, CodecSizeStats{
+			Codec:         codec.Name(),
+			PostingsBytes: totals[i],
+			IndexBytes:    indexBytes,
+			LabelNames:    sizeStats(labelNames[i].get(), indexBytes),
+			LabelPairs:    sizeStats(labelPairs[i].get(), indexBytes),
+		})
+	}
+	return res, nil
+}
+
+func sizeStats(stats []Stat, total uint64) []SizeStat {
+	res := make([]SizeStat, 0, len(stats))
+	for _, s := range stats {
+		res = append(res, SizeStat{Name: s.Name, Bytes: s.Count, Share: float64(s.Count) / float64(total)})
+	}
+	return res
+}
+
+// WriteJSON writes the stats to w as JSON.
+func (s *PostingsSizeStats) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteTable writes the stats to w as text tables. The largest label names
+// and label pairs of all codecs are listed in the order of the first codec,
+// with their size, share of the index and rank under every codec, so that
+// changes in ranking between codecs stand out.
+func (s *PostingsSizeStats) WriteTable(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%-60s", "codec"); err != nil {
+		return err
+	}
+	for _, c := range s.Codecs {
+		if _, err := fmt.Fprintf(w, " %28s", c.Codec); err != nil {
+			return err
+		}
+	}
+	for _, row := range []struct {
+		title string
+		bytes func(CodecSizeStats) uint64
+	}{
+		{title: "postings bytes", bytes: func(c CodecSizeStats) uint64 { return c.PostingsBytes }},
+		{title: "index bytes", bytes: func(c CodecSizeStats) uint64 { return c.IndexBytes }},
+	} {
+		if _, err := fmt.Fprintf(w, "\n%-60s", row.title); err != nil {
+			return err
+		}
+		for _, c := range s.Codecs {
+			if _, err := fmt.Fprintf(w, " %28d", row.bytes(c)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+
+	for _, t := range []struct {
+		title string
+		stats func(CodecSizeStats) []SizeStat
+	}{
+		{title: "Label names with largest postings", stats: func(c CodecSizeStats) []SizeStat { return c.LabelNames }},
+		{title: "Label pairs with largest postings", stats: func(c CodecSizeStats) []SizeStat { return c.LabelPairs }},
+	} {
+		if err := s.writeRanking(w, t.title, t.stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostingsSizeStats) writeRanking(w io.Writer, title string, stats func(CodecSizeStats) []SizeStat) error {
+	type ranked struct {
+		stat SizeStat
+		rank int
+	}
+	var (
+		names   []string
+		byCodec = make([]map[string]ranked, len(s.Codecs))
+	)
+	for i, c := range s.Codecs {
+		byCodec[i] = map[string]ranked{}
+		for j, st := range stats(c) {
+			byCodec[i][st.Name] = ranked{stat: st, rank: j + 1}
+		}
+	}
+	seen := map[string]struct{}{}
+	for _, c := range s.Codecs {
+		for _, st := range stats(c) {
+			if _, ok := seen[st.Name]; !ok {
+				seen[st.Name] = struct{}{}
+				names = append(names, st.Name)
+			}
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "\n%s:\n", title); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "  %-58s", name); err != nil {
+			return err
+		}
+		for i := range s.Codecs {
+			r, ok := byCodec[i][name]
+			if !ok {
+				if _, err := fmt.Fprintf(w, " %28s", "-"); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := fmt.Fprintf(w, " %12d %6.2f%% #%-6d", r.stat.Bytes, 100*r.stat.Share, r.rank); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostingsSizeStats(t *testing.T) {
+	be, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(t, err)
+	defer be.Close()
+
+	codecs := []PostingsCodec{BigEndianPostingsCodec, RoaringPostingsCodec, BigEndian64PostingsCodec}
+	stats, err := be.PostingsSizeStats(codecs, 10)
+	require.NoError(t, err)
+	require.Len(t, stats.Codecs, len(codecs))
+
+	// Postings lists take the whole postings section of the index.
+	beStats := stats.Codecs[0]
+	require.Equal(t, BigEndianPostingsCodec.Name(), beStats.Codec)
+	require.Equal(t, be.toc.LabelIndicesTable-be.toc.Postings, beStats.PostingsBytes)
+	require.Equal(t, uint64(be.Size()), beStats.IndexBytes)
+	require.Len(t, beStats.LabelNames, 10)
+	require.Len(t, beStats.LabelPairs, 10)
+	require.Equal(t, "job=robust", beStats.LabelPairs[0].Name)
+	for _, c := range stats.Codecs {
+		for i, s := range c.LabelNames {
+			require.InDelta(t, float64(s.Bytes)/float64(c.IndexBytes), s.Share, 1e-9)
+			if i > 0 {
+				require.LessOrEqual(t, s.Bytes, c.LabelNames[i-1].Bytes)
+			}
+		}
+	}
+
+	// The sizes for another codec must match those of the index rewritten
+	// with it.
+	for i, codec := range codecs[1:] {
+		fn := filepath.Join(t.TempDir(), "index")
+		_, err := CompactIndexes(context.Background(), fn, codec, nil, be)
+		require.NoError(t, err)
+		r, err := NewFileReaderWithOptions(fn, ReaderOptions{PostingsCodec: codec})
+		require.NoError(t, err)
+
+		got, err := r.PostingsSizeStats([]PostingsCodec{codec}, 10)
+		require.NoError(t, err)
+		require.NoError(t, r.Close())
+
+		exp := stats.Codecs[i+1]
+		require.Equal(t, exp.PostingsBytes, got.Codecs[0].PostingsBytes, codec.Name())
+		require.Len(t, got.Codecs[0].LabelPairs, len(exp.LabelPairs))
+		for j, s := range got.Codecs[0].LabelPairs {
+			require.Equal(t, exp.LabelPairs[j].Name, s.Name, codec.Name())
+			require.Equal(t, exp.LabelPairs[j].Bytes, s.Bytes, codec.Name())
+		}
+		require.InEpsilon(t, exp.IndexBytes, got.Codecs[0].IndexBytes, 0.01, codec.Name())
+	}
+
+	// Roaring bitmap indexes written by the fork are only 4 byte aligned.
+	rb, err := NewFileReaderWithOptions(roaringBitmapIndexPath, ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+	require.NoError(t, err)
+	defer rb.Close()
+	align, err := rb.postingsAlignment()
+	require.NoError(t, err)
+	require.Equal(t, 4, align)
+	rbStats, err := rb.PostingsSizeStats([]PostingsCodec{RoaringPostingsCodec}, 10)
+	require.NoError(t, err)
+	require.Equal(t, rb.toc.LabelIndicesTable-rb.toc.Postings, rbStats.Codecs[0].PostingsBytes)
+	require.Equal(t, uint64(rb.Size()), rbStats.Codecs[0].IndexBytes)
+
+	// Negative limits report no label names or pairs.
+	none, err := be.PostingsSizeStats(codecs, -1)
+	require.NoError(t, err)
+	for _, c := range none.Codecs {
+		require.Empty(t, c.LabelNames)
+		require.Empty(t, c.LabelPairs)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, stats.WriteTable(&buf))
+	require.Contains(t, buf.String(), "roaring_bitmap")
+	require.Contains(t, buf.String(), "job=robust")
+
+	buf.Reset()
+	require.NoError(t, stats.WriteJSON(&buf))
+	var decoded PostingsSizeStats
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, *stats, decoded)
+}
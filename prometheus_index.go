@@ -26,7 +26,9 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"sync"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -105,6 +107,9 @@ func newCRC32() hash.Hash32 {
 	return crc32.New(castagnoliTable)
 }
 
+// defaultPostingsMemoryBudget is the default Writer.PostingsMemoryBudget.
+const defaultPostingsMemoryBudget = 1 << 30
+
 type symbolCacheEntry struct {
 	index          uint32
 	lastValue      string
@@ -145,9 +150,22 @@ type Writer struct {
 	// Hold last series to validate that clients insert new series in order.
 	lastSeries labels.Labels
 	lastRef    storage.SeriesRef
+	// Reference the last series was written at, i.e. its offset divided by 16.
+	lastWrittenRef storage.SeriesRef
 
 	crc32 hash.Hash
 
+	// Codec used to write out postings lists.
+	codec PostingsCodec
+
+	// PostingsMemoryBudget bounds the memory in bytes used to hold the series
+	// references of postings while they are generated, at 8 bytes each. Label
+	// names are processed in as many passes over the series as needed to stay
+	// within it. The encoded postings lists of a pass are held until they are
+	// written on top of that, which is up to another 8 bytes per reference
+	// depending on the codec, so memory use may reach twice the budget.
+	PostingsMemoryBudget uint64
+
 	Version int
 }
 
@@ -179,18 +197,33 @@ func NewTOCFromByteSlice(bs ByteSlice) (*TOC, error) {
 		return nil, err
 	}
 
-	return &TOC{
+	toc := &TOC{
 		Symbols:           d.Be64(),
 		Series:            d.Be64(),
 		LabelIndices:      d.Be64(),
 		LabelIndicesTable: d.Be64(),
 		Postings:          d.Be64(),
 		PostingsTable:     d.Be64(),
-	}, nil
+	}
+	// Sections must start before the TOC, so that reading them can't go out
+	// of bounds.
+	for _, off := range []uint64{toc.Symbols, toc.Series, toc.LabelIndices, toc.LabelIndicesTable, toc.Postings, toc.PostingsTable} {
+		if off > uint64(bs.Len()-indexTOCLen) {
+			return nil, errors.Errorf("section offset %d out of bounds of the index of size %d", off, bs.Len())
+		}
+	}
+	return toc, nil
 }
 
-// NewWriter returns a new Writer to the given filename. It serializes data in format version 2.
+// NewWriter returns a new Writer to the given filename. It serializes data in format version 2
+// with big endian postings.
 func NewWriter(ctx context.Context, fn string) (*Writer, error) {
+	return NewWriterWithCodec(ctx, fn, BigEndianPostingsCodec)
+}
+
+// NewWriterWithCodec returns a new Writer to the given filename that writes
+// postings lists with the given codec.
+func NewWriterWithCodec(ctx context.Context, fn string, codec PostingsCodec) (*Writer, error) {
 	dir := filepath.Dir(fn)
 
 	df, err := fileutil.OpenDir(dir)
@@ -208,6 +241,11 @@ func NewWriter(ctx context.Context, fn string) (*Writer, error) {
 	if err != nil {
 		return nil, err
 	}
+	if codec.MaxSeriesRef() > math.MaxUint32 {
+		// Series references are the only 4 byte offsets into the file, so
+		// codecs with wider references can address larger indexes.
+		f.maxSize = math.MaxInt64
+	}
 	// Temporary file for postings.
 	fP, err := NewFileWriter(fn + "_tmp_p")
 	if err != nil {
@@ -236,6 +274,9 @@ func NewWriter(ctx context.Context, fn string) (*Writer, error) {
 		symbolCache: make(map[string]symbolCacheEntry, 1<<8),
 		labelNames:  make(map[string]uint64, 1<<8),
 		crc32:       newCRC32(),
+		codec:       codec,
+
+		PostingsMemoryBudget: defaultPostingsMemoryBudget,
 	}
 	if err := iw.writeMeta(); err != nil {
 		return nil, err
@@ -260,6 +301,9 @@ type FileWriter struct {
 	fbuf *bufio.Writer
 	pos  uint64
 	name string
+
+	// maxSize is the size the file must not grow beyond.
+	maxSize uint64
 }
 
 func NewFileWriter(name string) (*FileWriter, error) {
@@ -272,6 +316,11 @@ func NewFileWriter(name string) (*FileWriter, error) {
 		fbuf: bufio.NewWriterSize(f, 1<<22),
 		pos:  0,
 		name: name,
+		// For now the index file must not grow beyond 64GiB. Some of the fixed-sized
+		// offset references in v1 are only 4 bytes large.
+		// Once we move to compressed/varint representations in those areas, this limitation
+		// can be lifted.
+		maxSize: 16 * math.MaxUint32,
 	}, nil
 }
 
@@ -286,12 +335,8 @@ func (fw *FileWriter) Write(bufs ...[]byte) error {
 		if err != nil {
 			return err
 		}
-		// For now the index file must not grow beyond 64GiB. Some of the fixed-sized
-		// offset references in v1 are only 4 bytes large.
-		// Once we move to compressed/varint representations in those areas, this limitation
-		// can be lifted.
-		if fw.pos > 16*math.MaxUint32 {
-			return errors.Errorf("%q exceeding max size of 64GiB", fw.name)
+		if fw.pos > fw.maxSize {
+			return errors.Errorf("%q exceeding max size of %d bytes", fw.name, fw.maxSize)
 		}
 	}
 	return nil
@@ -435,6 +480,10 @@ func (w *Writer) AddSeries(ref storage.SeriesRef, lset labels.Labels, chunks ...
 	if w.f.pos%16 != 0 {
 		return errors.Errorf("series write not 16-byte aligned at %d", w.f.pos)
 	}
+	if w.f.pos/16 > w.codec.MaxSeriesRef() {
+		return errors.Errorf("series offset %d exceeds what %s postings can reference", w.f.pos/16, w.codec.Name())
+	}
+	w.lastWrittenRef = storage.SeriesRef(w.f.pos / 16)
 
 	w.buf2.Reset()
 	w.buf2.PutUvarint(len(lset))
@@ -831,36 +880,15 @@ func (w *Writer) writePostingsToTmpFiles() error {
 	}
 	defer f.Close()
 
-	// Write out the special all posting.
-	offsets := []uint32{}
-	d := encoding.NewDecbufRaw(realByteSlice(f.Bytes()), int(w.toc.LabelIndices))
-	d.Skip(int(w.toc.Series))
-	for d.Len() > 0 {
-		d.ConsumePadding()
-		startPos := w.toc.LabelIndices - uint64(d.Len())
-		if startPos%16 != 0 {
-			return errors.Errorf("series not 16-byte aligned at %d", startPos)
-		}
-		offsets = append(offsets, uint32(startPos/16))
-		// Skip to next series.
-		x := d.Uvarint()
-		d.Skip(x + crc32.Size)
-		if err := d.Err(); err != nil {
-			return err
-		}
-	}
-	if err := w.writePosting("", "", offsets); err != nil {
-		return err
-	}
-	maxPostings := uint64(len(offsets)) // No label name can have more postings than this.
-
-	for len(names) > 0 {
+	budget := w.PostingsMemoryBudget / 8 // Postings are held as 8 byte references.
+	first := true
+	for first || len(names) > 0 {
 		batchNames := []string{}
 		var c uint64
-		// Try to bunch up label names into one loop, but avoid
-		// using more memory than a single label name can.
+		// Try to bunch up label names into one pass over the series, but
+		// stay within the memory budget unless a single label name exceeds it.
 		for len(names) > 0 {
-			if w.labelNames[names[0]]+c > maxPostings {
+			if len(batchNames) > 0 && w.labelNames[names[0]]+c > budget {
 				break
 			}
 			batchNames = append(batchNames, names[0])
@@ -868,63 +896,23 @@ func (w *Writer) writePostingsToTmpFiles() error {
 			names = names[1:]
 		}
 
-		nameSymbols := map[uint32]string{}
-		for _, name := range batchNames {
-			sid, err := w.symbols.ReverseLookup(name)
-			if err != nil {
-				return err
-			}
-			nameSymbols[sid] = name
-		}
-		// Label name -> label value -> positions.
-		postings := map[uint32]map[uint32][]uint32{}
-
-		d := encoding.NewDecbufRaw(realByteSlice(f.Bytes()), int(w.toc.LabelIndices))
-		d.Skip(int(w.toc.Series))
-		for d.Len() > 0 {
-			d.ConsumePadding()
-			startPos := w.toc.LabelIndices - uint64(d.Len())
-			l := d.Uvarint() // Length of this series in bytes.
-			startLen := d.Len()
-
-			// See if label names we want are in the series.
-			numLabels := d.Uvarint()
-			for i := 0; i < numLabels; i++ {
-				lno := uint32(d.Uvarint())
-				lvo := uint32(d.Uvarint())
-
-				if _, ok := nameSymbols[lno]; ok {
-					if _, ok := postings[lno]; !ok {
-						postings[lno] = map[uint32][]uint32{}
-					}
-					postings[lno][lvo] = append(postings[lno][lvo], uint32(startPos/16))
-				}
-			}
-			// Skip to next series.
-			d.Skip(l - (startLen - d.Len()) + crc32.Size)
-			if err := d.Err(); err != nil {
+		// The first pass also collects the special all postings, which are written out first.
+		all, postings, err := w.generatePostings(f.Bytes(), batchNames, first)
+		if err != nil {
+			return err
+		}
+		if first {
+			if err := w.writePosting("", "", all); err != nil {
 				return err
 			}
+			first = false
 		}
-
-		for _, name := range batchNames {
-			// Write out postings for this label name.
-			sid, err := w.symbols.ReverseLookup(name)
-			if err != nil {
+		for i, name := range batchNames {
+			if err := w.ctx.Err(); err != nil {
 				return err
 			}
-			values := make([]uint32, 0, len(postings[sid]))
-			for v := range postings[sid] {
-				values = append(values, v)
-			}
-			// Symbol numbers are in order, so the strings will also be in order.
-			sort.Sort(uint32slice(values))
-			for _, v := range values {
-				value, err := w.symbols.Lookup(v)
-				if err != nil {
-					return err
-				}
-				if err := w.writePosting(name, value, postings[sid][v]); err != nil {
+			for _, p := range postings[i] {
+				if err := w.writeEncodedPosting(name, p.value, p.frame); err != nil {
 					return err
 				}
 			}
@@ -934,52 +922,248 @@ func (w *Writer) writePostingsToTmpFiles() error {
 			return w.ctx.Err()
 		default:
 		}
+	}
+	return nil
+}
+
+// postingsEntry is a single reference to add to the postings list of a label pair.
+type postingsEntry struct {
+	name, value uint32
+	ref         uint64
+}
+
+// postingsEntriesBatchSize is the number of postingsEntry passed to a worker
+// at once in Writer.generatePostings().
+const postingsEntriesBatchSize = 4096
+
+// encodedPosting is a postings list for a label value, framed as in the index.
+type encodedPosting struct {
+	value string
+	frame []byte
+}
+
+// generatePostings decodes the series in b once and builds the postings lists
+// of the given sorted label names. The label names are spread across as many
+// workers as there are CPUs, which build and encode their postings lists in
+// parallel. The returned lists are in the order of names and of their values.
+// If all is true, the references of all series are returned as well.
+func (w *Writer) generatePostings(b []byte, names []string, all bool) ([]uint64, [][]encodedPosting, error) {
+	n := runtime.GOMAXPROCS(0)
+	if n > len(names) {
+		n = len(names)
+	}
+
+	// Assign each label name to the worker with the fewest postings so far.
+	owners := make(map[uint32]int, len(names))
+	nameIndex := make(map[uint32]int, len(names))
+	loads := make([]uint64, n)
+	for i, name := range names {
+		sid, err := w.symbols.ReverseLookup(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		least := 0
+		for j := range loads {
+			if loads[j] < loads[least] {
+				least = j
+			}
+		}
+		owners[sid] = least
+		nameIndex[sid] = i
+		loads[least] += w.labelNames[name]
+	}
+
+	var (
+		wg      sync.WaitGroup
+		workc   = make([]chan []postingsEntry, n)
+		errs    = make([]error, n)
+		results = make([][]encodedPosting, len(names))
+	)
+	for i := range workc {
+		workc[i] = make(chan []postingsEntry, 1)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Label name -> label value -> positions.
+			postings := map[uint32]map[uint32][]uint64{}
+			for job := range workc[i] {
+				for _, e := range job {
+					if _, ok := postings[e.name]; !ok {
+						postings[e.name] = map[uint32][]uint64{}
+					}
+					postings[e.name][e.value] = append(postings[e.name][e.value], e.ref)
+				}
+			}
+			errs[i] = w.encodePostings(postings, nameIndex, results)
+		}(i)
+	}
 
+	var allRefs []uint64
+	err := w.decodePostingsEntries(b, owners, all, workc, &allRefs)
+	for i := range workc {
+		close(workc[i])
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return allRefs, results, nil
+}
+
+// decodePostingsEntries scans the series section in b and sends the label
+// pairs of every series to the worker owning their label name.
+func (w *Writer) decodePostingsEntries(b []byte, owners map[uint32]int, all bool, workc []chan []postingsEntry, allRefs *[]uint64) error {
+	batches := make([][]postingsEntry, len(workc))
+	d := encoding.NewDecbufRaw(realByteSlice(b), int(w.toc.LabelIndices))
+	d.Skip(int(w.toc.Series))
+	for d.Len() > 0 {
+		d.ConsumePadding()
+		startPos := w.toc.LabelIndices - uint64(d.Len())
+		if startPos%16 != 0 {
+			return errors.Errorf("series not 16-byte aligned at %d", startPos)
+		}
+		ref := startPos / 16
+		if all {
+			*allRefs = append(*allRefs, ref)
+		}
+		l := d.Uvarint() // Length of this series in bytes.
+		startLen := d.Len()
+
+		// See if label names we want are in the series.
+		numLabels := d.Uvarint()
+		for i := 0; i < numLabels; i++ {
+			lno := uint32(d.Uvarint())
+			lvo := uint32(d.Uvarint())
+
+			o, ok := owners[lno]
+			if !ok {
+				continue
+			}
+			batches[o] = append(batches[o], postingsEntry{name: lno, value: lvo, ref: ref})
+			if len(batches[o]) == postingsEntriesBatchSize {
+				select {
+				case workc[o] <- batches[o]:
+				case <-w.ctx.Done():
+					return w.ctx.Err()
+				}
+				batches[o] = make([]postingsEntry, 0, postingsEntriesBatchSize)
+			}
+		}
+		// Skip to next series.
+		d.Skip(l - (startLen - d.Len()) + crc32.Size)
+		if err := d.Err(); err != nil {
+			return err
+		}
+	}
+	// Push the partially filled batches too.
+	for o, batch := range batches {
+		if len(batch) > 0 {
+			workc[o] <- batch
+		}
 	}
 	return nil
 }
 
-func (w *Writer) writePosting(name, value string, offs []uint32) error {
-	// Align beginning to 4 bytes for more efficient postings list scans.
-	if err := w.fP.AddPadding(4); err != nil {
-		return err
+// encodePostings encodes the postings lists built by a worker into the slots
+// of results given by nameIndex, with their label values in order.
+func (w *Writer) encodePostings(postings map[uint32]map[uint32][]uint64, nameIndex map[uint32]int, results [][]encodedPosting) error {
+	var (
+		buf encoding.Encbuf
+		crc = newCRC32()
+	)
+	for sid, byValue := range postings {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		values := make([]uint32, 0, len(byValue))
+		for v := range byValue {
+			values = append(values, v)
+		}
+		// Symbol numbers are in order, so the strings will also be in order.
+		sort.Sort(uint32slice(values))
+
+		encoded := make([]encodedPosting, 0, len(values))
+		for _, v := range values {
+			value, err := w.symbols.Lookup(v)
+			if err != nil {
+				return err
+			}
+			buf.Reset()
+			if err := w.encodePosting(&buf, crc, byValue[v]); err != nil {
+				return err
+			}
+			frame := make([]byte, buf.Len())
+			copy(frame, buf.Get())
+			encoded = append(encoded, encodedPosting{value: value, frame: frame})
+		}
+		results[nameIndex[sid]] = encoded
 	}
+	return nil
+}
 
-	// Write out postings offset table to temporary file as we go.
+func (w *Writer) writePosting(name, value string, offs []uint64) error {
 	w.buf1.Reset()
-	w.buf1.PutUvarint(2)
-	w.buf1.PutUvarintStr(name)
-	w.buf1.PutUvarintStr(value)
-	w.buf1.PutUvarint64(w.fP.pos) // This is relative to the postings tmp file, not the final index file.
-	if err := w.fPO.Write(w.buf1.Get()); err != nil {
+	if err := w.encodePosting(&w.buf1, w.crc32, offs); err != nil {
 		return err
 	}
-	w.cntPO++
-
-	w.buf1.Reset()
-	w.buf1.PutBE32int(len(offs))
+	return w.writeEncodedPosting(name, value, w.buf1.Get())
+}
 
-	for _, off := range offs {
-		if off > (1<<32)-1 {
-			return errors.Errorf("series offset %d exceeds 4 bytes", off)
-		}
-		w.buf1.PutBE32(off)
+// encodePosting appends the postings list for offs to e, framed by its length
+// and a CRC32.
+func (w *Writer) encodePosting(e *encoding.Encbuf, crc hash.Hash, offs []uint64) error {
+	// Leave 4 bytes of space for the length, which will be calculated later.
+	e.PutBE32int(0)
+	if err := w.codec.EncodePostings(e, offs); err != nil {
+		return err
 	}
 
-	w.buf2.Reset()
-	l := w.buf1.Len()
+	l := e.Len() - 4
 	// We convert to uint to make code compile on 32-bit systems, as math.MaxUint32 doesn't fit into int there.
 	if uint(l) > math.MaxUint32 {
 		return errors.Errorf("posting size exceeds 4 bytes: %d", l)
 	}
-	w.buf2.PutBE32int(l)
-	w.buf1.PutHash(w.crc32)
-	return w.fP.Write(w.buf2.Get(), w.buf1.Get())
+	binary.BigEndian.PutUint32(e.B, uint32(l))
+
+	crc.Reset()
+	if _, err := crc.Write(e.B[4:]); err != nil {
+		return err
+	}
+	e.PutHashSum(crc)
+	return nil
+}
+
+// writeEncodedPosting writes a framed postings list to the temporary postings
+// file, and its entry to the temporary postings offset table.
+func (w *Writer) writeEncodedPosting(name, value string, frame []byte) error {
+	// Align beginning as the codec requires, so that postings lists can be
+	// scanned efficiently or used in place.
+	if err := w.fP.AddPadding(w.codec.Alignment()); err != nil {
+		return err
+	}
+
+	// Write out postings offset table to temporary file as we go.
+	w.buf2.Reset()
+	w.buf2.PutUvarint(2)
+	w.buf2.PutUvarintStr(name)
+	w.buf2.PutUvarintStr(value)
+	w.buf2.PutUvarint64(w.fP.pos) // This is relative to the postings tmp file, not the final index file.
+	if err := w.fPO.Write(w.buf2.Get()); err != nil {
+		return err
+	}
+	w.cntPO++
+
+	return w.fP.Write(frame)
 }
 
 func (w *Writer) writePostings() error {
 	// There's padding in the tmp file, make sure it actually works.
-	if err := w.f.AddPadding(4); err != nil {
+	if err := w.f.AddPadding(w.codec.Alignment()); err != nil {
 		return err
 	}
 	w.postingsStart = w.f.pos
@@ -1079,6 +1263,31 @@ type Reader struct {
 	dec *Decoder
 
 	version int
+	// Every postingsFactor-th label value of a name is kept in postings.
+	postingsFactor int
+	// postingsTableEnd is the offset of the end of the entries of the
+	// postings offset table.
+	postingsTableEnd int
+}
+
+// ReaderOptions configures how an index is read.
+type ReaderOptions struct {
+	// PostingsCodec the postings lists of the index were written with.
+	// Defaults to BigEndianPostingsCodec.
+	PostingsCodec PostingsCodec
+
+	// SymbolsFactor is the sampling factor of the symbol table: the offset
+	// of every SymbolsFactor-th symbol is kept in memory. Defaults to
+	// DefaultSymbolsFactor.
+	SymbolsFactor int
+	// PostingsOffsetsFactor is the sampling factor of the postings offset
+	// table: every PostingsOffsetsFactor-th label value of each name, and
+	// the last one, is kept in memory with its offset. Defaults to
+	// DefaultPostingsOffsetsFactor.
+	//
+	// Lower factors take more memory and speed up lookups, which scan the
+	// table from the closest sampled entry.
+	PostingsOffsetsFactor int
 }
 
 type postingOffset struct {
@@ -1109,16 +1318,29 @@ func (b realByteSlice) Sub(start, end int) ByteSlice {
 // NewReader returns a new index reader on the given byte slice. It automatically
 // handles different format versions.
 func NewReader(b ByteSlice) (*Reader, error) {
-	return newReader(b, ioutil.NopCloser(nil))
+	return NewReaderWithOptions(b, ReaderOptions{})
+}
+
+// NewReaderWithOptions returns a new index reader on the given byte slice
+// configured by opts.
+func NewReaderWithOptions(b ByteSlice, opts ReaderOptions) (*Reader, error) {
+	return newReader(b, ioutil.NopCloser(nil), opts)
 }
 
 // NewFileReader returns a new index reader against the given index file.
 func NewFileReader(path string) (*Reader, error) {
+	return NewFileReaderWithOptions(path, ReaderOptions{})
+}
+
+// NewFileReaderWithOptions returns a new index reader against the given index
+// file configured by opts. The file is mmapped, and postings lists are read
+// from it in place.
+func NewFileReaderWithOptions(path string, opts ReaderOptions) (*Reader, error) {
 	f, err := fileutil.OpenMmapFile(path)
 	if err != nil {
 		return nil, err
 	}
-	r, err := newReader(realByteSlice(f.Bytes()), f)
+	r, err := newReader(realByteSlice(f.Bytes()), f, opts)
 	if err != nil {
 		return nil, tsdb_errors.NewMulti(
 			err,
@@ -1129,11 +1351,24 @@ func NewFileReader(path string) (*Reader, error) {
 	return r, nil
 }
 
-func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
+func newReader(b ByteSlice, c io.Closer, opts ReaderOptions) (*Reader, error) {
+	if opts.PostingsCodec == nil {
+		opts.PostingsCodec = BigEndianPostingsCodec
+	}
+	if opts.SymbolsFactor == 0 {
+		opts.SymbolsFactor = DefaultSymbolsFactor
+	}
+	if opts.PostingsOffsetsFactor == 0 {
+		opts.PostingsOffsetsFactor = DefaultPostingsOffsetsFactor
+	}
+	if opts.SymbolsFactor < 0 || opts.PostingsOffsetsFactor < 0 {
+		return nil, errors.Errorf("invalid sampling factors %d and %d", opts.SymbolsFactor, opts.PostingsOffsetsFactor)
+	}
 	r := &Reader{
-		b:        b,
-		c:        c,
-		postings: map[string][]postingOffset{},
+		b:              b,
+		c:              c,
+		postings:       map[string][]postingOffset{},
+		postingsFactor: opts.PostingsOffsetsFactor,
 	}
 
 	// Verify header.
@@ -1155,7 +1390,7 @@ func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
 		return nil, errors.Wrap(err, "read TOC")
 	}
 
-	r.symbols, err = NewSymbols(r.b, r.version, int(r.toc.Symbols))
+	r.symbols, err = NewSymbolsWithFactor(r.b, r.version, int(r.toc.Symbols), opts.SymbolsFactor)
 	if err != nil {
 		return nil, errors.Wrap(err, "read symbols")
 	}
@@ -1178,46 +1413,13 @@ func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
 			return nil, errors.Wrap(err, "read postings table")
 		}
 	} else {
-		var lastKey []string
-		lastOff := 0
-		valueCount := 0
-		// For the postings offset table we keep every label name but only every nth
-		// label value (plus the first and last one), to save memory.
-		if err := ReadOffsetTable(r.b, r.toc.PostingsTable, func(key []string, _ uint64, off int) error {
-			if len(key) != 2 {
-				return errors.Errorf("unexpected key length for posting table %d", len(key))
-			}
-			if _, ok := r.postings[key[0]]; !ok {
-				// Next label name.
-				r.postings[key[0]] = []postingOffset{}
-				if lastKey != nil {
-					// Always include last value for each label name.
-					r.postings[lastKey[0]] = append(r.postings[lastKey[0]], postingOffset{value: lastKey[1], off: lastOff})
-				}
-				lastKey = nil
-				valueCount = 0
-			}
-			if valueCount%symbolFactor == 0 {
-				r.postings[key[0]] = append(r.postings[key[0]], postingOffset{value: key[1], off: off})
-				lastKey = nil
-			} else {
-				lastKey = key
-				lastOff = off
-			}
-			valueCount++
-			return nil
-		}); err != nil {
-			return nil, errors.Wrap(err, "read postings table")
-		}
-		if lastKey != nil {
-			r.postings[lastKey[0]] = append(r.postings[lastKey[0]], postingOffset{value: lastKey[1], off: lastOff})
-		}
-		// Trim any extra space in the slices.
-		for k, v := range r.postings {
-			l := make([]postingOffset, len(v))
-			copy(l, v)
-			r.postings[k] = l
+		r.postings, err = readPostingsOffsets(r.b, r.toc.PostingsTable, r.postingsFactor)
+		if err != nil {
+			return nil, err
 		}
+		// Reading the table checked its length.
+		start := int(r.toc.PostingsTable) + 4
+		r.postingsTableEnd = start + int(binary.BigEndian.Uint32(r.b.Range(start-4, start)))
 	}
 
 	r.nameSymbols = make(map[uint32]string, len(r.postings))
@@ -1232,11 +1434,57 @@ func newReader(b ByteSlice, c io.Closer) (*Reader, error) {
 		r.nameSymbols[off] = k
 	}
 
-	r.dec = &Decoder{LookupSymbol: r.lookupSymbol}
+	r.dec = &Decoder{LookupSymbol: r.lookupSymbol, Codec: opts.PostingsCodec}
 
 	return r, nil
 }
 
+// readPostingsOffsets reads the postings offset table at off, keeping every
+// label name but only every factor-th label value (plus the first and last
+// one) with its offset in the table, to save memory.
+func readPostingsOffsets(bs ByteSlice, off uint64, factor int) (map[string][]postingOffset, error) {
+	postings := map[string][]postingOffset{}
+	var lastKey []string
+	lastOff := 0
+	valueCount := 0
+	if err := ReadOffsetTable(bs, off, func(key []string, _ uint64, off int) error {
+		if len(key) != 2 {
+			return errors.Errorf("unexpected key length for posting table %d", len(key))
+		}
+		if _, ok := postings[key[0]]; !ok {
+			// Next label name.
+			postings[key[0]] = []postingOffset{}
+			if lastKey != nil {
+				// Always include last value for each label name.
+				postings[lastKey[0]] = append(postings[lastKey[0]], postingOffset{value: lastKey[1], off: lastOff})
+			}
+			lastKey = nil
+			valueCount = 0
+		}
+		if valueCount%factor == 0 {
+			postings[key[0]] = append(postings[key[0]], postingOffset{value: key[1], off: off})
+			lastKey = nil
+		} else {
+			lastKey = key
+			lastOff = off
+		}
+		valueCount++
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "read postings table")
+	}
+	if lastKey != nil {
+		postings[lastKey[0]] = append(postings[lastKey[0]], postingOffset{value: lastKey[1], off: lastOff})
+	}
+	// Trim any extra space in the slices.
+	for k, v := range postings {
+		l := make([]postingOffset, len(v))
+		copy(l, v)
+		postings[k] = l
+	}
+	return postings, nil
+}
+
 // Version returns the file format version of the underlying index.
 func (r *Reader) Version() int {
 	return r.version
@@ -1274,19 +1522,34 @@ type Symbols struct {
 	bs      ByteSlice
 	version int
 	off     int
+	factor  int
 
 	offsets []int
 	seen    int
 }
 
-const symbolFactor = 32
+// Default sampling factors of the symbol and postings offset tables.
+const (
+	DefaultSymbolsFactor         = 32
+	DefaultPostingsOffsetsFactor = 32
+)
 
 // NewSymbols returns a Symbols object for symbol lookups.
 func NewSymbols(bs ByteSlice, version, off int) (*Symbols, error) {
+	return NewSymbolsWithFactor(bs, version, off, DefaultSymbolsFactor)
+}
+
+// NewSymbolsWithFactor returns a Symbols object for symbol lookups, which keeps
+// the offset of every factor-th symbol.
+func NewSymbolsWithFactor(bs ByteSlice, version, off, factor int) (*Symbols, error) {
+	if factor < 1 {
+		return nil, errors.Errorf("invalid symbols factor %d", factor)
+	}
 	s := &Symbols{
 		bs:      bs,
 		version: version,
 		off:     off,
+		factor:  factor,
 	}
 	d := encoding.NewDecbufAt(bs, off, castagnoliTable)
 	var (
@@ -1294,9 +1557,13 @@ func NewSymbols(bs ByteSlice, version, off int) (*Symbols, error) {
 		cnt     = d.Be32int()
 		basePos = off + 4
 	)
-	s.offsets = make([]int, 0, 1+cnt/symbolFactor)
+	// Every symbol takes at least a byte for its length.
+	if cnt > d.Len() {
+		return nil, errors.Errorf("%d symbols in a table of %d bytes", cnt, origLen)
+	}
+	s.offsets = make([]int, 0, 1+cnt/factor)
 	for d.Err() == nil && s.seen < cnt {
-		if s.seen%symbolFactor == 0 {
+		if s.seen%factor == 0 {
 			s.offsets = append(s.offsets, basePos+origLen-d.Len())
 		}
 		d.UvarintBytes() // The symbol.
@@ -1317,9 +1584,9 @@ func (s Symbols) Lookup(o uint32) (string, error) {
 		if int(o) >= s.seen {
 			return "", errors.Errorf("unknown symbol offset %d", o)
 		}
-		d.Skip(s.offsets[int(o/symbolFactor)])
+		d.Skip(s.offsets[int(o)/s.factor])
 		// Walk until we find the one we want.
-		for i := o - (o / symbolFactor * symbolFactor); i > 0; i-- {
+		for i := int(o) % s.factor; i > 0; i-- {
 			d.UvarintBytes()
 		}
 	} else {
@@ -1352,7 +1619,7 @@ func (s Symbols) ReverseLookup(sym string) (uint32, error) {
 		i--
 	}
 	d.Skip(s.offsets[i])
-	res := i * symbolFactor
+	res := i * s.factor
 	var lastLen int
 	var lastSymbol string
 	for d.Err() == nil && res <= s.seen {
@@ -1422,6 +1689,10 @@ func ReadOffsetTable(bs ByteSlice, off uint64, f func([]string, uint64, int) err
 	for d.Err() == nil && d.Len() > 0 && cnt > 0 {
 		offsetPos := startLen - d.Len()
 		keyCount := d.Uvarint()
+		// Every key takes at least a byte for its length.
+		if keyCount < 0 || keyCount > d.Len() {
+			return errors.Errorf("invalid key count %d in offset table entry", keyCount)
+		}
 		// The Postings offset table takes only 2 keys per entry (name and value of label),
 		// and the LabelIndices offset table takes only 1 key per entry (a label name).
 		// Hence setting the size to max of both, i.e. 2.
@@ -1503,10 +1774,9 @@ func (r *Reader) LabelValues(name string, matchers ...*labels.Matcher) ([]string
 	if len(e) == 0 {
 		return nil, nil
 	}
-	values := make([]string, 0, len(e)*symbolFactor)
+	values := make([]string, 0, len(e)*r.postingsFactor)
 
-	d := encoding.NewDecbufAt(r.b, int(r.toc.PostingsTable), nil)
-	d.Skip(e[0].off)
+	d := encoding.Decbuf{B: r.postingsOffsetEntries(name, e[0], e[len(e)-1])}
 	lastVal := e[len(e)-1].value
 
 	skip := 0
@@ -1540,14 +1810,11 @@ func (r *Reader) LabelNamesFor(ids ...storage.SeriesRef) ([]string, error) {
 	// Gather offsetsMap the name offsetsMap in the symbol table first
 	offsetsMap := make(map[uint32]struct{})
 	for _, id := range ids {
-		offset := id
-		// In version 2 series IDs are no longer exact references but series are 16-byte padded
-		// and the ID is the multiple of 16 of the actual position.
-		if r.version == FormatV2 {
-			offset = id * 16
+		offset, err := r.seriesOffset(id)
+		if err != nil {
+			return nil, err
 		}
-
-		d := encoding.NewDecbufUvarintAt(r.b, int(offset), castagnoliTable)
+		d := encoding.NewDecbufUvarintAt(r.b, offset, castagnoliTable)
 		buf := d.Get()
 		if d.Err() != nil {
 			return nil, errors.Wrap(d.Err(), "get buffer for series")
@@ -1579,13 +1846,11 @@ func (r *Reader) LabelNamesFor(ids ...storage.SeriesRef) ([]string, error) {
 
 // LabelValueFor returns label value for the given label name in the series referred to by ID.
 func (r *Reader) LabelValueFor(id storage.SeriesRef, label string) (string, error) {
-	offset := id
-	// In version 2 series IDs are no longer exact references but series are 16-byte padded
-	// and the ID is the multiple of 16 of the actual position.
-	if r.version == FormatV2 {
-		offset = id * 16
+	offset, err := r.seriesOffset(id)
+	if err != nil {
+		return "", err
 	}
-	d := encoding.NewDecbufUvarintAt(r.b, int(offset), castagnoliTable)
+	d := encoding.NewDecbufUvarintAt(r.b, offset, castagnoliTable)
 	buf := d.Get()
 	if d.Err() != nil {
 		return "", errors.Wrap(d.Err(), "label values for")
@@ -1603,54 +1868,104 @@ func (r *Reader) LabelValueFor(id storage.SeriesRef, label string) (string, erro
 	return value, nil
 }
 
-// Series reads the series with the given ID and writes its labels and chunks into lbls and chks.
-func (r *Reader) Series(id storage.SeriesRef, lbls *labels.Labels, chks *[]chunks.Meta) error {
-	offset := id
+// seriesOffset returns the position of the series with the given ID in the
+// index.
+func (r *Reader) seriesOffset(id storage.SeriesRef) (int, error) {
+	offset := uint64(id)
 	// In version 2 series IDs are no longer exact references but series are 16-byte padded
 	// and the ID is the multiple of 16 of the actual position.
 	if r.version == FormatV2 {
-		offset = id * 16
+		if offset > math.MaxUint64/16 {
+			return 0, errors.Errorf("series ID %d out of range", id)
+		}
+		offset *= 16
+	}
+	if offset >= uint64(r.b.Len()) {
+		return 0, errors.Wrapf(encoding.ErrInvalidSize, "series ID %d out of range", id)
+	}
+	return int(offset), nil
+}
+
+// Series reads the series with the given ID and writes its labels and chunks into lbls and chks.
+func (r *Reader) Series(id storage.SeriesRef, lbls *labels.Labels, chks *[]chunks.Meta) error {
+	offset, err := r.seriesOffset(id)
+	if err != nil {
+		return err
 	}
-	d := encoding.NewDecbufUvarintAt(r.b, int(offset), castagnoliTable)
+	d := encoding.NewDecbufUvarintAt(r.b, offset, castagnoliTable)
 	if d.Err() != nil {
 		return d.Err()
 	}
 	return errors.Wrap(r.dec.Series(d.Get(), lbls, chks), "read series")
 }
 
+// SeriesLabels reads the labels of the series with the given ID into lbls,
+// without decoding its chunks.
+func (r *Reader) SeriesLabels(id storage.SeriesRef, lbls *labels.Labels) error {
+	offset, err := r.seriesOffset(id)
+	if err != nil {
+		return err
+	}
+	d := encoding.NewDecbufUvarintAt(r.b, offset, castagnoliTable)
+	if d.Err() != nil {
+		return d.Err()
+	}
+	return errors.Wrap(r.dec.Labels(d.Get(), lbls), "read series labels")
+}
+
 func (r *Reader) Postings(name string, values ...string) (Postings, error) {
+	res := make([]Postings, 0, len(values))
+	if err := r.postingsLists(name, values, func(_ string, b []byte) error {
+		_, p, err := r.dec.Postings(b)
+		if err != nil {
+			return errors.Wrap(err, "decode postings")
+		}
+		res = append(res, p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return Merge(res...), nil
+}
+
+// postingsLists calls f with the encoded postings list of each of the given
+// sorted label values of name that exist in the index. The byte slice passed
+// to f is only valid for the lifetime of the Reader.
+func (r *Reader) postingsLists(name string, values []string, f func(value string, b []byte) error) error {
 	if r.version == FormatV1 {
 		e, ok := r.postingsV1[name]
 		if !ok {
-			return EmptyPostings(), nil
+			return nil
 		}
-		res := make([]Postings, 0, len(values))
 		for _, v := range values {
 			postingsOff, ok := e[v]
 			if !ok {
 				continue
 			}
+			if postingsOff > uint64(r.b.Len()) {
+				return errors.Wrapf(encoding.ErrInvalidSize, "postings offset %d", postingsOff)
+			}
 			// Read from the postings table.
 			d := encoding.NewDecbufAt(r.b, int(postingsOff), castagnoliTable)
-			_, p, err := r.dec.Postings(d.Get())
-			if err != nil {
-				return nil, errors.Wrap(err, "decode postings")
+			if d.Err() != nil {
+				return errors.Wrap(d.Err(), "get postings entry")
+			}
+			if err := f(v, d.Get()); err != nil {
+				return err
 			}
-			res = append(res, p)
 		}
-		return Merge(res...), nil
+		return nil
 	}
 
 	e, ok := r.postings[name]
 	if !ok {
-		return EmptyPostings(), nil
+		return nil
 	}
 
 	if len(values) == 0 {
-		return EmptyPostings(), nil
+		return nil
 	}
 
-	res := make([]Postings, 0, len(values))
 	skip := 0
 	valueIndex := 0
 	for valueIndex < len(values) && values[valueIndex] < e[0].value {
@@ -1670,9 +1985,9 @@ func (r *Reader) Postings(name string, values ...string) (Postings, error) {
 			i--
 		}
 		// Don't Crc32 the entire postings offset table, this is very slow
-		// so hope any issues were caught at startup.
-		d := encoding.NewDecbufAt(r.b, int(r.toc.PostingsTable), nil)
-		d.Skip(e[i].off)
+		// so hope any issues were caught at startup. Entries are read up
+		// to the next sampled one at most.
+		d := encoding.Decbuf{B: r.postingsOffsetEntries(name, e[i], e[minInt(i+1, len(e)-1)])}
 
 		// Iterate on the offset table.
 		var postingsOff uint64 // The offset into the postings table.
@@ -1691,13 +2006,17 @@ func (r *Reader) Postings(name string, values ...string) (Postings, error) {
 			postingsOff = d.Uvarint64() // Offset.
 			for string(v) >= value {
 				if string(v) == value {
+					if postingsOff > uint64(r.b.Len()) {
+						return errors.Wrapf(encoding.ErrInvalidSize, "postings offset %d", postingsOff)
+					}
 					// Read from the postings table.
 					d2 := encoding.NewDecbufAt(r.b, int(postingsOff), castagnoliTable)
-					_, p, err := r.dec.Postings(d2.Get())
-					if err != nil {
-						return nil, errors.Wrap(err, "decode postings")
+					if d2.Err() != nil {
+						return errors.Wrap(d2.Err(), "get postings entry")
+					}
+					if err := f(value, d2.Get()); err != nil {
+						return err
 					}
-					res = append(res, p)
 				}
 				valueIndex++
 				if valueIndex == len(values) {
@@ -1711,17 +2030,100 @@ func (r *Reader) Postings(name string, values ...string) (Postings, error) {
 			}
 		}
 		if d.Err() != nil {
-			return nil, errors.Wrap(d.Err(), "get postings offset entry")
+			return errors.Wrap(d.Err(), "get postings offset entry")
 		}
 	}
+	return nil
+}
+
+// postingsOffsetEntries returns the entries of the postings offset table of the
+// label name from the sampled entry from to the end of the sampled entry to,
+// so that only those are read from the index. It returns no bytes for invalid
+// entries, which then fail to decode.
+func (r *Reader) postingsOffsetEntries(name string, from, to postingOffset) []byte {
+	start := int(r.toc.PostingsTable) + 4
+	// The last entry takes at most its key count, the label name and value
+	// with their lengths, and the postings offset.
+	end := start + to.off + 1 + 2*binary.MaxVarintLen32 + len(name) + len(to.value) + binary.MaxVarintLen64
+	if end > r.postingsTableEnd {
+		end = r.postingsTableEnd
+	}
+	start += from.off
+	if from.off < 0 || start > end || end > r.b.Len() {
+		return nil
+	}
+	return r.b.Range(start, end)
+}
 
-	return Merge(res...), nil
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 // SortedPostings returns the given postings list reordered so that the backing series
-// are sorted.
+// are sorted. Only the labels of the series are decoded.
 func (r *Reader) SortedPostings(p Postings) Postings {
-	return p
+	return sortPostingsByLabels(p, r.SeriesLabels)
+}
+
+// sortPostingsByLabels returns the postings of p ordered by the label sets of
+// their series, which series reads. Series IDs are usually assigned in label
+// order, so p is first assumed to be ordered, which only needs the labels of
+// two series at a time. The labels of all series are only read and sorted
+// once a series is found out of order.
+func sortPostingsByLabels(p Postings, series func(storage.SeriesRef, *labels.Labels) error) Postings {
+	var (
+		refs      []storage.SeriesRef
+		prev, cur labels.Labels
+	)
+	for p.Next() {
+		if err := series(p.At(), &cur); err != nil {
+			return ErrPostings(errors.Wrapf(err, "read series %d", p.At()))
+		}
+		refs = append(refs, p.At())
+		if len(refs) > 1 && labels.Compare(prev, cur) > 0 {
+			return sortPostingsUnordered(refs, p, series)
+		}
+		prev, cur = cur, prev
+	}
+	if err := p.Err(); err != nil {
+		return ErrPostings(errors.Wrap(err, "expand postings"))
+	}
+	return NewListPostings(refs)
+}
+
+// sortPostingsUnordered returns refs followed by the rest of p, ordered by
+// the label sets of their series.
+func sortPostingsUnordered(refs []storage.SeriesRef, p Postings, series func(storage.SeriesRef, *labels.Labels) error) Postings {
+	for p.Next() {
+		refs = append(refs, p.At())
+	}
+	if err := p.Err(); err != nil {
+		return ErrPostings(errors.Wrap(err, "expand postings"))
+	}
+
+	type refLabels struct {
+		ref  storage.SeriesRef
+		lset labels.Labels
+	}
+	sorted := make([]refLabels, 0, len(refs))
+	for _, ref := range refs {
+		s := refLabels{ref: ref}
+		if err := series(ref, &s.lset); err != nil {
+			return ErrPostings(errors.Wrapf(err, "read series %d", ref))
+		}
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return labels.Compare(sorted[i].lset, sorted[j].lset) < 0
+	})
+
+	for i, s := range sorted {
+		refs[i] = s.ref
+	}
+	return NewListPostings(refs)
 }
 
 // Size returns the size of an index file.
@@ -1770,16 +2172,116 @@ func (s *stringListIter) Next() bool {
 func (s stringListIter) At() string { return s.cur }
 func (s stringListIter) Err() error { return nil }
 
+// NewMergedStringIter returns string iterator that allows to merge symbols on demand and stream result.
+func NewMergedStringIter(a, b StringIter) StringIter {
+	return &mergedStringIter{a: a, b: b, aok: a.Next(), bok: b.Next()}
+}
+
+type mergedStringIter struct {
+	a        StringIter
+	b        StringIter
+	aok, bok bool
+	cur      string
+}
+
+func (m *mergedStringIter) Next() bool {
+	if (!m.aok && !m.bok) || (m.Err() != nil) {
+		return false
+	}
+
+	if !m.aok {
+		m.cur = m.b.At()
+		m.bok = m.b.Next()
+	} else if !m.bok {
+		m.cur = m.a.At()
+		m.aok = m.a.Next()
+	} else if m.b.At() > m.a.At() {
+		m.cur = m.a.At()
+		m.aok = m.a.Next()
+	} else if m.a.At() > m.b.At() {
+		m.cur = m.b.At()
+		m.bok = m.b.Next()
+	} else { // Equal.
+		m.cur = m.b.At()
+		m.aok = m.a.Next()
+		m.bok = m.b.Next()
+	}
+
+	return true
+}
+func (m mergedStringIter) At() string { return m.cur }
+func (m mergedStringIter) Err() error {
+	if m.a.Err() != nil {
+		return m.a.Err()
+	}
+	return m.b.Err()
+}
+
 // Decoder provides decoding methods for the v1 and v2 index file format.
 //
 // It currently does not contain decoding methods for all entry types but can be extended
 // by them if there's demand.
 type Decoder struct {
 	LookupSymbol func(uint32) (string, error)
+
+	// Codec decodes postings lists. Big endian postings are assumed if nil.
+	Codec PostingsCodec
 }
 
 // Postings returns a postings list for b and its number of elements.
 func (dec *Decoder) Postings(b []byte) (int, Postings, error) {
+	if dec.Codec == nil {
+		return BigEndianPostingsCodec.DecodePostings(b)
+	}
+	return dec.Codec.DecodePostings(b)
+}
+
+// PostingsCodec encodes and decodes the postings lists of an index. A postings
+// list is stored as the codec's payload framed by a 4 byte length and a CRC32.
+type PostingsCodec interface {
+	// Name identifies the codec, e.g. in benchmark names.
+	Name() string
+
+	// Alignment is the byte alignment of every postings list, including its
+	// length, within the index file.
+	Alignment() int
+
+	// MaxSeriesRef is the largest series reference the codec can store.
+	MaxSeriesRef() uint64
+
+	// EncodePostings appends the payload for the given sorted series
+	// references to e.
+	EncodePostings(e *encoding.Encbuf, offs []uint64) error
+
+	// DecodePostings returns a postings list for the payload b and its number of elements.
+	DecodePostings(b []byte) (int, Postings, error)
+}
+
+// BigEndianPostingsCodec writes postings as a count followed by 4 byte big
+// endian series references. It is the standard Prometheus format.
+var BigEndianPostingsCodec PostingsCodec = bigEndianPostingsCodec{}
+
+type bigEndianPostingsCodec struct{}
+
+func (bigEndianPostingsCodec) Name() string { return "big_endian" }
+
+func (bigEndianPostingsCodec) Alignment() int { return 4 }
+
+func (bigEndianPostingsCodec) MaxSeriesRef() uint64 { return math.MaxUint32 }
+
+func (bigEndianPostingsCodec) EncodePostings(e *encoding.Encbuf, offs []uint64) error {
+	e.PutBE32int(len(offs))
+
+	for _, off := range offs {
+		if off > (1<<32)-1 {
+			return errors.Errorf("series offset %d exceeds 4 bytes", off)
+		}
+		e.PutBE32(uint32(off))
+	}
+	return nil
+}
+
+func (bigEndianPostingsCodec) DecodePostings(b []byte) (int, Postings, error) {
 	d := encoding.Decbuf{B: b}
 	n := d.Be32int()
 	l := d.Get()
@@ -1792,11 +2294,61 @@ func (dec *Decoder) Postings(b []byte) (int, Postings, error) {
 	return n, newBigEndianPostings(l), nil
 }
 
+// BigEndian64PostingsCodec writes postings as a count followed by 8 byte big
+// endian series references, lifting the 64GiB limit of 4 byte references.
+var BigEndian64PostingsCodec PostingsCodec = bigEndian64PostingsCodec{}
+
+type bigEndian64PostingsCodec struct{}
+
+func (bigEndian64PostingsCodec) Name() string { return "big_endian_64" }
+
+func (bigEndian64PostingsCodec) Alignment() int { return 8 }
+
+func (bigEndian64PostingsCodec) MaxSeriesRef() uint64 { return math.MaxUint64 }
+
+func (bigEndian64PostingsCodec) EncodePostings(e *encoding.Encbuf, offs []uint64) error {
+	e.PutBE32int(len(offs))
+	for _, off := range offs {
+		e.PutBE64(off)
+	}
+	return nil
+}
+
+func (bigEndian64PostingsCodec) DecodePostings(b []byte) (int, Postings, error) {
+	d := encoding.Decbuf{B: b}
+	n := d.Be32int()
+	l := d.Get()
+	if d.Err() != nil {
+		return 0, nil, d.Err()
+	}
+	if len(l) != 8*n {
+		return 0, nil, fmt.Errorf("unexpected postings length, should be %d bytes for %d postings, got %d bytes", 8*n, n, len(l))
+	}
+	return n, newBigEndian64Postings(l), nil
+}
+
+// postingsCodecs are all known postings codecs.
+var postingsCodecs = []PostingsCodec{BigEndianPostingsCodec, BigEndian64PostingsCodec, RoaringPostingsCodec}
+
+// PostingsCodecByName returns the postings codec with the given name.
+func PostingsCodecByName(name string) (PostingsCodec, error) {
+	for _, c := range postingsCodecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, errors.Errorf("unknown postings codec %q", name)
+}
+
 // LabelNamesOffsetsFor decodes the offsets of the name symbols for a given series.
 // They are returned in the same order they're stored, which should be sorted lexicographically.
 func (dec *Decoder) LabelNamesOffsetsFor(b []byte) ([]uint32, error) {
 	d := encoding.Decbuf{B: b}
 	k := d.Uvarint()
+	// Every label takes at least a byte for each of its name and value.
+	if k < 0 || k > d.Len()/2 {
+		return nil, errors.Errorf("invalid number of labels %d in series", k)
+	}
 
 	offsets := make([]uint32, k)
 	for i := 0; i < k; i++ {
@@ -1844,35 +2396,15 @@ func (dec *Decoder) LabelValueFor(b []byte, label string) (string, error) {
 
 // Series decodes a series entry from the given byte slice into lset and chks.
 func (dec *Decoder) Series(b []byte, lbls *labels.Labels, chks *[]chunks.Meta) error {
-	*lbls = (*lbls)[:0]
 	*chks = (*chks)[:0]
 
 	d := encoding.Decbuf{B: b}
-
-	k := d.Uvarint()
-
-	for i := 0; i < k; i++ {
-		lno := uint32(d.Uvarint())
-		lvo := uint32(d.Uvarint())
-
-		if d.Err() != nil {
-			return errors.Wrap(d.Err(), "read series label offsets")
-		}
-
-		ln, err := dec.LookupSymbol(lno)
-		if err != nil {
-			return errors.Wrap(err, "lookup label name")
-		}
-		lv, err := dec.LookupSymbol(lvo)
-		if err != nil {
-			return errors.Wrap(err, "lookup label value")
-		}
-
-		*lbls = append(*lbls, labels.Label{Name: ln, Value: lv})
+	if err := dec.labels(&d, lbls); err != nil {
+		return err
 	}
 
 	// Read the chunks meta data.
-	k = d.Uvarint()
+	k := d.Uvarint()
 
 	if k == 0 {
 		return d.Err()
@@ -1909,6 +2441,41 @@ func (dec *Decoder) Series(b []byte, lbls *labels.Labels, chks *[]chunks.Meta) e
 	return d.Err()
 }
 
+// Labels decodes the labels of a series entry from the given byte slice into
+// lbls, skipping its chunks.
+func (dec *Decoder) Labels(b []byte, lbls *labels.Labels) error {
+	d := encoding.Decbuf{B: b}
+	return dec.labels(&d, lbls)
+}
+
+// labels decodes the labels at the start of a series entry into lbls.
+func (dec *Decoder) labels(d *encoding.Decbuf, lbls *labels.Labels) error {
+	*lbls = (*lbls)[:0]
+
+	k := d.Uvarint()
+
+	for i := 0; i < k; i++ {
+		lno := uint32(d.Uvarint())
+		lvo := uint32(d.Uvarint())
+
+		if d.Err() != nil {
+			return errors.Wrap(d.Err(), "read series label offsets")
+		}
+
+		ln, err := dec.LookupSymbol(lno)
+		if err != nil {
+			return errors.Wrap(err, "lookup label name")
+		}
+		lv, err := dec.LookupSymbol(lvo)
+		if err != nil {
+			return errors.Wrap(err, "lookup label value")
+		}
+
+		*lbls = append(*lbls, labels.Label{Name: ln, Value: lv})
+	}
+	return d.Err()
+}
+
 func yoloString(b []byte) string {
 	return *((*string)(unsafe.Pointer(&b)))
 }
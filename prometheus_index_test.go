@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteIndex writes the big endian index at src to dst, encoding postings
+// with the given codec. The Writer may be adjusted by configure before use.
+func rewriteIndex(tb testing.TB, src, dst string, codec PostingsCodec, configure ...func(*Writer)) {
+	r, err := NewFileReader(src)
+	require.NoError(tb, err)
+	defer r.Close()
+
+	w, err := NewWriterWithCodec(context.Background(), dst, codec)
+	require.NoError(tb, err)
+	for _, c := range configure {
+		c(w)
+	}
+
+	syms := r.Symbols()
+	for syms.Next() {
+		require.NoError(tb, w.AddSymbol(syms.At()))
+	}
+	require.NoError(tb, syms.Err())
+
+	p, err := r.Postings(AllPostingsKey())
+	require.NoError(tb, err)
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+	)
+	for p.Next() {
+		require.NoError(tb, r.Series(p.At(), &lset, &chks))
+		require.NoError(tb, w.AddSeries(p.At(), lset, chks...))
+	}
+	require.NoError(tb, p.Err())
+	require.NoError(tb, w.Close())
+}
+
+// indexSeries is a series as stored in an index.
+type indexSeries struct {
+	lset labels.Labels
+	chks []chunks.Meta
+}
+
+// readIndexSeries returns all series of r in order.
+func readIndexSeries(tb testing.TB, r *Reader) []indexSeries {
+	p, err := r.Postings(AllPostingsKey())
+	require.NoError(tb, err)
+	var series []indexSeries
+	for p.Next() {
+		var s indexSeries
+		require.NoError(tb, r.Series(p.At(), &s.lset, &s.chks))
+		series = append(series, s)
+	}
+	require.NoError(tb, p.Err())
+	return series
+}
+
+// writeIndex writes the given symbols and sorted series to a new index at path.
+func writeIndex(tb testing.TB, path string, codec PostingsCodec, symbols []string, series []indexSeries) {
+	w, err := NewWriterWithCodec(context.Background(), path, codec)
+	require.NoError(tb, err)
+	for _, sym := range symbols {
+		require.NoError(tb, w.AddSymbol(sym))
+	}
+	for i, s := range series {
+		require.NoError(tb, w.AddSeries(storage.SeriesRef(i), s.lset, s.chks...))
+	}
+	require.NoError(tb, w.Close())
+}
+
+// readSymbols returns all symbols of r.
+func readSymbols(tb testing.TB, r *Reader) []string {
+	var symbols []string
+	it := r.Symbols()
+	for it.Next() {
+		symbols = append(symbols, it.At())
+	}
+	require.NoError(tb, it.Err())
+	return symbols
+}
+
+func TestWriterReproducesIndex(t *testing.T) {
+	exp, err := ioutil.ReadFile(bigEndianIndexPath)
+	require.NoError(t, err)
+
+	for _, budget := range []uint64{defaultPostingsMemoryBudget, 1 << 10, 1} {
+		t.Run(fmt.Sprintf("budget=%d", budget), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "index")
+			rewriteIndex(t, bigEndianIndexPath, path, BigEndianPostingsCodec, func(w *Writer) {
+				w.PostingsMemoryBudget = budget
+			})
+			got, err := ioutil.ReadFile(path)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(exp, got), "rewritten index differs from %s", bigEndianIndexPath)
+		})
+	}
+}
+
+func TestRoaringPostingsCodec(t *testing.T) {
+	rbPath := filepath.Join(t.TempDir(), "index")
+	rewriteIndex(t, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	be, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(t, err)
+	defer be.Close()
+	rb, err := NewFileReaderWithOptions(rbPath, ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+	require.NoError(t, err)
+	defer rb.Close()
+
+	ranges, err := rb.PostingsRanges()
+	require.NoError(t, err)
+	for l, rng := range ranges {
+		// The bitmap follows the 4 byte count, and must be 8 byte aligned to be used in place.
+		require.Zero(t, (rng.Start+4)%8, "bitmap for %s not aligned", l)
+
+		bep, err := be.Postings(l.Name, l.Value)
+		require.NoError(t, err)
+		exp, err := ExpandPostings(bep)
+		require.NoError(t, err)
+
+		rbp, err := rb.Postings(l.Name, l.Value)
+		require.NoError(t, err)
+		_, ok := rbp.(*bitmapPostings)
+		require.True(t, ok, "expected bitmap postings for %s", l)
+		got, err := ExpandPostings(rbp)
+		require.NoError(t, err)
+		require.Equal(t, exp, got, "postings for %s", l)
+	}
+}
+
+func TestSortedPostings(t *testing.T) {
+	rbPath := filepath.Join(t.TempDir(), "index")
+	rewriteIndex(t, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		t.Run(c.codec.Name(), func(t *testing.T) {
+			ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+			require.NoError(t, err)
+			defer ir.Close()
+
+			for _, ms := range testMatcherSets {
+				p, err := PostingsForMatchers(ir, ms...)
+				require.NoError(t, err)
+				exp, err := ExpandPostings(p)
+				require.NoError(t, err)
+
+				// Series of an index are in label order already.
+				p, err = PostingsForMatchers(ir, ms...)
+				require.NoError(t, err)
+				got, err := ExpandPostings(ir.SortedPostings(p))
+				require.NoError(t, err)
+				require.Equal(t, exp, got)
+
+				// Out of order references come back in label order.
+				shuffled := append([]storage.SeriesRef(nil), exp...)
+				rand.New(rand.NewSource(int64(len(exp)))).Shuffle(len(shuffled), func(i, j int) {
+					shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+				})
+				got, err = ExpandPostings(ir.SortedPostings(NewListPostings(shuffled)))
+				require.NoError(t, err)
+				require.Equal(t, exp, got)
+				var prev, lset labels.Labels
+				for i, ref := range got {
+					require.NoError(t, ir.SeriesLabels(ref, &lset))
+					if i > 0 {
+						require.Less(t, labels.Compare(prev, lset), 0)
+					}
+					prev, lset = lset, prev
+				}
+			}
+		})
+	}
+
+	// Series IDs that are not in label order, as for remapped series.
+	series := map[storage.SeriesRef]labels.Labels{
+		1: labels.FromStrings("a", "3"),
+		2: labels.FromStrings("a", "1"),
+		3: labels.FromStrings("a", "1", "b", "1"),
+		4: labels.FromStrings("a", "0"),
+		5: labels.FromStrings("a", "4"),
+	}
+	lookup := func(id storage.SeriesRef, lset *labels.Labels) error {
+		l, ok := series[id]
+		if !ok {
+			return storage.ErrNotFound
+		}
+		*lset = append((*lset)[:0], l...)
+		return nil
+	}
+	got, err := ExpandPostings(sortPostingsByLabels(newListPostings(1, 2, 3, 4, 5), lookup))
+	require.NoError(t, err)
+	require.Equal(t, []storage.SeriesRef{4, 2, 3, 1, 5}, got)
+
+	got, err = ExpandPostings(sortPostingsByLabels(newListPostings(2, 3, 5), lookup))
+	require.NoError(t, err)
+	require.Equal(t, []storage.SeriesRef{2, 3, 5}, got)
+
+	_, err = ExpandPostings(sortPostingsByLabels(newListPostings(1, 2, 6), lookup))
+	require.Error(t, err)
+}
+
+func BenchmarkOpenIndex(b *testing.B) {
+	dir := b.TempDir()
+	for _, codec := range []PostingsCodec{BigEndianPostingsCodec, RoaringPostingsCodec} {
+		path := filepath.Join(dir, codec.Name())
+		rewriteIndex(b, bigEndianIndexPath, path, codec)
+
+		b.Run(codec.Name(), func(b *testing.B) {
+			var before, after runtime.MemStats
+			var heap int64
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				r, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: codec})
+				require.NoError(b, err)
+
+				// Decode every postings list once, as queries would over time.
+				values, err := r.LabelValues("job")
+				require.NoError(b, err)
+				p, err := r.Postings("job", values...)
+				require.NoError(b, err)
+				_, err = ExpandPostings(p)
+				require.NoError(b, err)
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				heap += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+				runtime.KeepAlive(r)
+				require.NoError(b, r.Close())
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "heap-bytes/op")
+		})
+	}
+}
+
+func BenchmarkRealIndexSetOperations(b *testing.B) {
+	rbPath := filepath.Join(b.TempDir(), "index")
+	rewriteIndex(b, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(b, err)
+		defer ir.Close()
+
+		jobs := []string{"demo", "prometheus", "promscale", "robust"}
+		postings := func() []Postings {
+			ps := make([]Postings, 0, len(jobs))
+			for _, job := range jobs {
+				p, err := ir.Postings("job", job)
+				require.NoError(b, err)
+				ps = append(ps, p)
+			}
+			return ps
+		}
+
+		b.Run(fmt.Sprintf("intersect_%s", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := ExpandPostings(Intersect(postings()...))
+				require.NoError(b, err)
+			}
+		})
+		b.Run(fmt.Sprintf("union_%s", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := ExpandPostings(Merge(postings()...))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestPostingsCodecs64BitRefs(t *testing.T) {
+	refs := []uint64{1, 1 << 20, math.MaxUint32, 1 << 32, 1<<40 + 7, math.MaxUint64 >> 4}
+
+	for _, codec := range []PostingsCodec{BigEndianPostingsCodec, BigEndian64PostingsCodec, RoaringPostingsCodec} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			var e encoding.Encbuf
+			err := codec.EncodePostings(&e, refs)
+			if codec.MaxSeriesRef() <= math.MaxUint32 {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			n, p, err := codec.DecodePostings(e.Get())
+			require.NoError(t, err)
+			require.Equal(t, len(refs), n)
+			got, err := ExpandPostings(p)
+			require.NoError(t, err)
+			require.Equal(t, toSeriesRefs(refs), got)
+
+			_, p, err = codec.DecodePostings(e.Get())
+			require.NoError(t, err)
+			require.True(t, p.Seek(1<<33))
+			require.Equal(t, storage.SeriesRef(1<<40+7), p.At())
+		})
+	}
+
+	// 4 byte postings must not wrap around when seeking past their range.
+	p := getBigEndianPostings([]uint32{1, 5, math.MaxUint32})
+	require.False(t, p.Seek(1<<32+1))
+}
+
+func BenchmarkSortedPostings(b *testing.B) {
+	rbPath := filepath.Join(b.TempDir(), "index")
+	rewriteIndex(b, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(b, err)
+		defer ir.Close()
+
+		b.Run(fmt.Sprintf("%s/ordered", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p, err := ir.Postings(AllPostingsKey())
+				require.NoError(b, err)
+				_, err = ExpandPostings(ir.SortedPostings(p))
+				require.NoError(b, err)
+			}
+		})
+		b.Run(fmt.Sprintf("%s/unordered", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p, err := ir.Postings(AllPostingsKey())
+				require.NoError(b, err)
+				_, err = ExpandPostings(sortPostingsUnordered(nil, p, ir.SeriesLabels))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkPostingsCodecs(b *testing.B) {
+	const numSeries = 100000
+	for _, space := range []struct {
+		name string
+		base uint64
+	}{
+		{name: "32bit", base: 0},
+		{name: "64bit", base: 1 << 40},
+	} {
+		// Two interleaved postings lists, as for a pair of label values.
+		lists := make([][]uint64, 2)
+		for i := uint64(0); i < numSeries; i++ {
+			lists[0] = append(lists[0], space.base+i*3)
+			lists[1] = append(lists[1], space.base+i*2)
+		}
+
+		for _, codec := range []PostingsCodec{BigEndianPostingsCodec, BigEndian64PostingsCodec, RoaringPostingsCodec} {
+			encoded := make([][]byte, len(lists))
+			var size int
+			for i, l := range lists {
+				var e encoding.Encbuf
+				// Frame the payload with its length, as in the index, to keep its alignment.
+				e.PutBE32int(0)
+				if err := codec.EncodePostings(&e, l); err != nil {
+					// The ID space does not fit this codec.
+					encoded = nil
+					break
+				}
+				encoded[i] = e.Get()[4:]
+				size += len(encoded[i])
+			}
+			if encoded == nil {
+				continue
+			}
+
+			b.Run(fmt.Sprintf("%s/%s/encode", space.name, codec.Name()), func(b *testing.B) {
+				b.ReportAllocs()
+				var e encoding.Encbuf
+				for i := 0; i < b.N; i++ {
+					e.Reset()
+					require.NoError(b, codec.EncodePostings(&e, lists[0]))
+				}
+				b.ReportMetric(float64(size)/float64(len(lists)), "bytes/list")
+			})
+			b.Run(fmt.Sprintf("%s/%s/decode", space.name, codec.Name()), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, p, err := codec.DecodePostings(encoded[0])
+					require.NoError(b, err)
+					_, err = ExpandPostings(p)
+					require.NoError(b, err)
+				}
+			})
+			b.Run(fmt.Sprintf("%s/%s/intersect", space.name, codec.Name()), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, p1, err := codec.DecodePostings(encoded[0])
+					require.NoError(b, err)
+					_, p2, err := codec.DecodePostings(encoded[1])
+					require.NoError(b, err)
+					_, err = ExpandPostings(Intersect(p1, p2))
+					require.NoError(b, err)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkWriteIndex(b *testing.B) {
+	dir := b.TempDir()
+	for _, codec := range []PostingsCodec{BigEndianPostingsCodec, BigEndian64PostingsCodec, RoaringPostingsCodec} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rewriteIndex(b, bigEndianIndexPath, filepath.Join(dir, codec.Name()), codec)
+			}
+		})
+	}
+}
+
+// crcRegion is a CRC32 protected part of an index file, with its checksum
+// following at end.
+type crcRegion struct {
+	start, end int
+}
+
+// indexCRCRegions returns the checksummed regions of the index b read by r.
+func indexCRCRegions(tb testing.TB, r *Reader, b []byte) []crcRegion {
+	regions := []crcRegion{{start: len(b) - indexTOCLen, end: len(b) - crc32.Size}}
+	for _, off := range []uint64{r.toc.Symbols, r.toc.PostingsTable} {
+		d := encoding.NewDecbufAt(realByteSlice(b), int(off), nil)
+		require.NoError(tb, d.Err())
+		regions = append(regions, crcRegion{start: int(off) + 4, end: int(off) + 4 + d.Len()})
+	}
+
+	ranges, err := r.PostingsRanges()
+	require.NoError(tb, err)
+	for _, rng := range ranges {
+		regions = append(regions, crcRegion{start: int(rng.Start), end: int(rng.End)})
+	}
+
+	p, err := r.Postings(AllPostingsKey())
+	require.NoError(tb, err)
+	for p.Next() {
+		off := int(p.At()) * 16
+		l, n := binary.Uvarint(b[off:])
+		require.Greater(tb, n, 0)
+		regions = append(regions, crcRegion{start: off + n, end: off + n + int(l)})
+	}
+	require.NoError(tb, p.Err())
+	return regions
+}
+
+// fixCRCs recomputes the checksums of the regions of b, so that mutations of
+// their contents get past the checksum verification.
+func fixCRCs(b []byte, regions []crcRegion) {
+	for _, rg := range regions {
+		if rg.end+crc32.Size > len(b) {
+			continue
+		}
+		binary.BigEndian.PutUint32(b[rg.end:], crc32.Checksum(b[rg.start:rg.end], castagnoliTable))
+	}
+}
+
+// exerciseReader calls every entry point of r, bounding the work done so that
+// corrupted counts and lengths don't make it run for too long. Errors are
+// fine, panics are not.
+func exerciseReader(r *Reader) {
+	const maxItems = 1000
+
+	it := r.Symbols()
+	for i := 0; i < maxItems && it.Next(); i++ {
+		_ = it.At()
+	}
+	_ = it.Err()
+	_ = r.SymbolTableSize()
+	_, _ = r.PostingsRanges()
+
+	var (
+		lset labels.Labels
+		chks []chunks.Meta
+		// References from corrupted postings may point anywhere.
+		refs = []storage.SeriesRef{0, 1, math.MaxUint32, math.MaxUint64/16 + 1, math.MaxUint64}
+	)
+	var pairs []labels.Label
+	names, _ := r.LabelNames()
+	for _, name := range names {
+		_, _ = r.LabelValues(name)
+		values, err := r.SortedLabelValues(name)
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, labels.Label{Name: name, Value: v})
+		}
+		p, err := r.Postings(name, values...)
+		if err != nil {
+			continue
+		}
+		for i := 0; i < maxItems && p.Next(); i++ {
+			refs = append(refs, p.At())
+		}
+		_ = p.Err()
+		if len(values) > 0 {
+			p, err = r.Postings(name, values[0])
+			if err == nil {
+				p.Seek(1 << 20)
+			}
+		}
+	}
+	if res, _, err := r.FetchPostings(pairs, 100); err == nil {
+		for _, p := range res {
+			for i := 0; i < maxItems && p.Next(); i++ {
+			}
+		}
+	}
+
+	p, err := r.Postings(AllPostingsKey())
+	if err == nil {
+		for i := 0; i < maxItems && p.Next(); i++ {
+			refs = append(refs, p.At())
+		}
+	}
+	for i, ref := range refs {
+		if i == maxItems {
+			break
+		}
+		_ = r.Series(ref, &lset, &chks)
+		_, _ = r.LabelNamesFor(ref)
+		_, _ = r.LabelValueFor(ref, "job")
+	}
+	sorted := r.SortedPostings(NewListPostings(refs))
+	for i := 0; i < maxItems && sorted.Next(); i++ {
+	}
+	_, _ = r.Stats("__name__", 5)
+}
+
+func FuzzReader(f *testing.F) {
+	type source struct {
+		b       []byte
+		codec   PostingsCodec
+		regions []crcRegion
+	}
+	var sources []source
+	for _, s := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: roaringBitmapIndexPath, codec: RoaringPostingsCodec},
+	} {
+		b, err := ioutil.ReadFile(s.path)
+		require.NoError(f, err)
+		r, err := NewReaderWithOptions(realByteSlice(b), ReaderOptions{PostingsCodec: s.codec})
+		require.NoError(f, err)
+		sources = append(sources, source{b: b, codec: s.codec, regions: indexCRCRegions(f, r, b)})
+	}
+
+	f.Add(false, true, uint32(0), []byte{})
+	f.Add(true, true, uint32(0), []byte{})
+	f.Add(false, false, uint32(100), []byte{0, 0, 5, 1})
+	f.Add(true, true, uint32(0), []byte{3, 50, 0, 255, 3, 50, 1, 255})
+	f.Add(false, true, uint32(0), []byte{3, 100, 10, 128, 0, 40, 0, 7})
+	f.Add(false, true, uint32(0), []byte{128, 0, 51, 128})
+	f.Add(true, true, uint32(0), []byte{128, 2, 0, 1, 128, 1, 0, 32})
+	// Mutations are given as 3 byte offsets into the file and a byte to xor
+	// there. Offsets with the highest bit set count from the end of the file,
+	// where the TOC and tables are. The file may also be truncated by a number
+	// of bytes.
+	f.Fuzz(func(t *testing.T, roaring, fixCRC bool, truncate uint32, mutations []byte) {
+		src := sources[0]
+		if roaring {
+			src = sources[1]
+		}
+		b := make([]byte, len(src.b)-int(truncate%uint32(len(src.b))))
+		copy(b, src.b)
+		for ; len(mutations) >= 4; mutations = mutations[4:] {
+			off := int(mutations[0]&0x7f)<<16 | int(mutations[1])<<8 | int(mutations[2])
+			if mutations[0]&0x80 != 0 {
+				off = len(b) - 1 - off
+			}
+			if off >= 0 && off < len(b) {
+				b[off] ^= mutations[3]
+			}
+		}
+		if fixCRC {
+			fixCRCs(b, src.regions)
+		}
+
+		r, err := NewReaderWithOptions(realByteSlice(b), ReaderOptions{PostingsCodec: src.codec})
+		if err != nil {
+			return
+		}
+		exerciseReader(r)
+	})
+}
+
+// frame returns b framed by its length and CRC32, as sections of an index
+// are.
+func frame(b []byte) []byte {
+	var e encoding.Encbuf
+	e.PutBE32int(len(b))
+	e.PutBytes(b)
+	e.PutBE32(crc32.Checksum(b, castagnoliTable))
+	return e.Get()
+}
+
+func FuzzNewSymbols(f *testing.F) {
+	var e encoding.Encbuf
+	e.PutBE32int(3)
+	for _, s := range []string{"a", "bc", "def"} {
+		e.PutUvarintStr(s)
+	}
+	f.Add(e.Get())
+	f.Add([]byte{0x80, 0, 0, 0, 1, 'a'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := NewSymbols(realByteSlice(frame(b)), FormatV2, 0)
+		if err != nil {
+			return
+		}
+		for i := 0; i < 100; i++ {
+			sym, err := s.Lookup(uint32(i))
+			if err != nil {
+				continue
+			}
+			_, _ = s.ReverseLookup(sym)
+		}
+		_, _ = s.ReverseLookup("b")
+		it := s.Iter()
+		for it.Next() {
+		}
+		_ = it.Err()
+	})
+}
+
+func FuzzReadOffsetTable(f *testing.F) {
+	var e encoding.Encbuf
+	e.PutBE32(2)
+	for _, v := range []string{"a", "b"} {
+		e.PutUvarint(2)
+		e.PutUvarintStr("name")
+		e.PutUvarintStr(v)
+		e.PutUvarint64(100)
+	}
+	f.Add(e.Get())
+	f.Add([]byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_ = ReadOffsetTable(realByteSlice(frame(b)), 0, func([]string, uint64, int) error { return nil })
+	})
+}
+
+func FuzzDecoderSeries(f *testing.F) {
+	r, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(f, err)
+	defer r.Close()
+
+	p, err := r.Postings("job", "demo")
+	require.NoError(f, err)
+	for i := 0; i < 3 && p.Next(); i++ {
+		d := encoding.NewDecbufUvarintAt(r.b, int(p.At())*16, castagnoliTable)
+		require.NoError(f, d.Err())
+		f.Add(d.Get())
+	}
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		_ = r.dec.Series(b, &lset, &chks)
+		_, _ = r.dec.LabelNamesOffsetsFor(b)
+		_, _ = r.dec.LabelValueFor(b, "job")
+	})
+}
+
+// generateIndexSeries returns n series with labels of various cardinalities
+// and their chunks, sorted by labels. It is deterministic for a seed.
+func generateIndexSeries(seed int64, n int) []indexSeries {
+	rnd := rand.New(rand.NewSource(seed))
+	seen := map[string]struct{}{}
+	series := make([]indexSeries, 0, n)
+	for len(series) < n {
+		b := labels.NewBuilder(nil)
+		b.Set(labels.MetricName, fmt.Sprintf("metric_%d", rnd.Intn(20)))
+		b.Set("job", fmt.Sprintf("job-%d", rnd.Intn(5)))
+		// More values than the sampling factors of symbols and postings
+		// offsets, so that lookups go through sampled entries.
+		b.Set("instance", fmt.Sprintf("host-%03d.example.com:%d", rnd.Intn(150), 9000+rnd.Intn(3)))
+		if rnd.Intn(3) == 0 {
+			b.Set("le", fmt.Sprintf("%g", float64(rnd.Intn(10))/4))
+		}
+		if rnd.Intn(50) == 0 {
+			b.Set("rare_ünicode", "välue "+fmt.Sprint(rnd.Intn(3)))
+		}
+		lset := b.Labels()
+		if _, ok := seen[lset.String()]; ok {
+			continue
+		}
+		seen[lset.String()] = struct{}{}
+
+		var (
+			chks []chunks.Meta
+			t    = rnd.Int63n(1000)
+		)
+		for i := rnd.Intn(4); i > 0; i-- {
+			mint := t + rnd.Int63n(100)
+			t = mint + rnd.Int63n(10000)
+			chks = append(chks, chunks.Meta{Ref: chunks.ChunkRef(rnd.Uint64() >> 1), MinTime: mint, MaxTime: t})
+		}
+		sort.Slice(chks, func(i, j int) bool { return chks[i].Ref < chks[j].Ref })
+		series = append(series, indexSeries{lset: lset, chks: chks})
+	}
+	sort.Slice(series, func(i, j int) bool { return labels.Compare(series[i].lset, series[j].lset) < 0 })
+	return series
+}
+
+// indexSymbols returns the sorted symbols of series.
+func indexSymbols(series []indexSeries) []string {
+	set := map[string]struct{}{}
+	for _, s := range series {
+		for _, l := range s.lset {
+			set[l.Name] = struct{}{}
+			set[l.Value] = struct{}{}
+		}
+	}
+	symbols := make([]string, 0, len(set))
+	for s := range set {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 1, 2000} {
+		series := generateIndexSeries(int64(n), n)
+		symbols := indexSymbols(series)
+
+		// The expected label values, and postings as positions in series.
+		values := map[string][]string{}
+		postings := map[labels.Label][]int{}
+		for i, s := range series {
+			for _, l := range s.lset {
+				if _, ok := postings[l]; !ok {
+					values[l.Name] = append(values[l.Name], l.Value)
+				}
+				postings[l] = append(postings[l], i)
+			}
+		}
+		names := make([]string, 0, len(values))
+		for name, vs := range values {
+			names = append(names, name)
+			sort.Strings(vs)
+		}
+		sort.Strings(names)
+
+		for _, codec := range postingsCodecs {
+			t.Run(fmt.Sprintf("series=%d/%s", n, codec.Name()), func(t *testing.T) {
+				dir := t.TempDir()
+				path := filepath.Join(dir, "index")
+				writeIndex(t, path, codec, symbols, series)
+
+				// Writing is deterministic.
+				writeIndex(t, filepath.Join(dir, "index2"), codec, symbols, series)
+				exp, err := ioutil.ReadFile(path)
+				require.NoError(t, err)
+				got, err := ioutil.ReadFile(filepath.Join(dir, "index2"))
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(exp, got), "index written twice differs")
+
+				r, err := NewFileReaderWithOptions(path, ReaderOptions{PostingsCodec: codec})
+				require.NoError(t, err)
+				defer r.Close()
+
+				require.Equal(t, symbols, nonNilStrings(readSymbols(t, r)))
+
+				// Series are stored in order, and the all postings list
+				// holds their references.
+				p, err := r.Postings(AllPostingsKey())
+				require.NoError(t, err)
+				refs, err := ExpandPostings(p)
+				require.NoError(t, err)
+				require.Len(t, refs, len(series))
+				var (
+					lset labels.Labels
+					chks []chunks.Meta
+				)
+				for i, ref := range refs {
+					require.NoError(t, r.Series(ref, &lset, &chks))
+					require.Equal(t, series[i].lset, lset)
+					require.Equal(t, len(series[i].chks), len(chks))
+					for j, c := range chks {
+						require.Equal(t, series[i].chks[j], c)
+					}
+
+					lnames, err := r.LabelNamesFor(ref)
+					require.NoError(t, err)
+					expNames := []string{}
+					for _, l := range series[i].lset {
+						expNames = append(expNames, l.Name)
+					}
+					require.Equal(t, expNames, lnames)
+					v, err := r.LabelValueFor(ref, "job")
+					require.NoError(t, err)
+					require.Equal(t, series[i].lset.Get("job"), v)
+				}
+
+				gotNames, err := r.LabelNames()
+				require.NoError(t, err)
+				require.Equal(t, names, nonNilStrings(gotNames))
+
+				expRefs := func(l labels.Label) []storage.SeriesRef {
+					var res []storage.SeriesRef
+					for _, i := range postings[l] {
+						res = append(res, refs[i])
+					}
+					return res
+				}
+				for _, name := range names {
+					vs, err := r.SortedLabelValues(name)
+					require.NoError(t, err)
+					require.Equal(t, values[name], vs)
+					vs, err = r.LabelValues(name)
+					require.NoError(t, err)
+					require.ElementsMatch(t, values[name], vs)
+
+					for _, v := range values[name] {
+						p, err := r.Postings(name, v)
+						require.NoError(t, err)
+						got, err := ExpandPostings(p)
+						require.NoError(t, err)
+						require.Equal(t, expRefs(labels.Label{Name: name, Value: v}), got, "%s=%q", name, v)
+					}
+
+					// All values at once, with one missing.
+					p, err := r.Postings(name, append([]string{""}, values[name]...)...)
+					require.NoError(t, err)
+					got, err := ExpandPostings(p)
+					require.NoError(t, err)
+					var exp []storage.SeriesRef
+					for i, ref := range refs {
+						if series[i].lset.Has(name) {
+							exp = append(exp, ref)
+						}
+					}
+					require.Equal(t, exp, got, name)
+				}
+				p, err = r.Postings("job", "missing")
+				require.NoError(t, err)
+				require.False(t, p.Next())
+				p, err = r.Postings("missing", "job-0")
+				require.NoError(t, err)
+				require.False(t, p.Next())
+
+				// The ranges cover the encoded postings lists.
+				ranges, err := r.PostingsRanges()
+				require.NoError(t, err)
+				allName, allValue := AllPostingsKey()
+				require.Len(t, ranges, len(postings)+1)
+				for l, rng := range ranges {
+					_, p, err := codec.DecodePostings(r.b.Range(int(rng.Start), int(rng.End)))
+					require.NoError(t, err)
+					got, err := ExpandPostings(p)
+					require.NoError(t, err)
+					if l.Name == allName && l.Value == allValue {
+						require.Equal(t, nonNilRefs(refs), got)
+						continue
+					}
+					require.Equal(t, expRefs(l), got, "%s=%q", l.Name, l.Value)
+				}
+			})
+		}
+	}
+}
+
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func nonNilRefs(refs []storage.SeriesRef) []storage.SeriesRef {
+	if len(refs) == 0 {
+		return nil
+	}
+	return refs
+}
+
+func TestReaderSamplingFactors(t *testing.T) {
+	series := generateIndexSeries(5, 2000)
+	path := filepath.Join(t.TempDir(), "index")
+	writeIndex(t, path, RoaringPostingsCodec, indexSymbols(series), series)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: path, codec: RoaringPostingsCodec},
+	} {
+		exp, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(t, err)
+		defer exp.Close()
+		symbols := readSymbols(t, exp)
+		names, err := exp.LabelNames()
+		require.NoError(t, err)
+
+		for _, f := range []struct{ symbols, postings int }{
+			{1, 1}, {2, 7}, {7, 2}, {DefaultSymbolsFactor, DefaultPostingsOffsetsFactor}, {1000, 1000},
+		} {
+			t.Run(fmt.Sprintf("%s/symbols=%d/postings=%d", c.codec.Name(), f.symbols, f.postings), func(t *testing.T) {
+				r, err := NewFileReaderWithOptions(c.path, ReaderOptions{
+					PostingsCodec:         c.codec,
+					SymbolsFactor:         f.symbols,
+					PostingsOffsetsFactor: f.postings,
+				})
+				require.NoError(t, err)
+				defer r.Close()
+
+				require.Equal(t, (len(symbols)+f.symbols-1)/f.symbols, len(r.symbols.offsets))
+				for _, sym := range symbols {
+					off, err := r.symbols.ReverseLookup(sym)
+					require.NoError(t, err)
+					expOff, err := exp.symbols.ReverseLookup(sym)
+					require.NoError(t, err)
+					require.Equal(t, expOff, off)
+					got, err := r.lookupSymbol(off)
+					require.NoError(t, err)
+					require.Equal(t, sym, got)
+				}
+
+				require.Equal(t, sampledPostingsOffsets(t, r, f.postings), r.MemoryStats().SampledPostingsOffsets)
+				for _, name := range names {
+					values, err := exp.SortedLabelValues(name)
+					require.NoError(t, err)
+					got, err := r.SortedLabelValues(name)
+					require.NoError(t, err)
+					require.Equal(t, values, got)
+
+					// Single values, and all values at once.
+					for _, v := range values {
+						requirePostingsEqual(t, exp, r, name, v)
+					}
+					requirePostingsEqual(t, exp, r, name, values...)
+				}
+			})
+		}
+	}
+
+	for _, opts := range []ReaderOptions{{SymbolsFactor: -1}, {PostingsOffsetsFactor: -1}} {
+		_, err := NewFileReaderWithOptions(path, opts)
+		require.Error(t, err)
+	}
+}
+
+// requirePostingsEqual requires that both readers return the same postings.
+func requirePostingsEqual(tb testing.TB, exp, got *Reader, name string, values ...string) {
+	p, err := exp.Postings(name, values...)
+	require.NoError(tb, err)
+	expRefs, err := ExpandPostings(p)
+	require.NoError(tb, err)
+	p, err = got.Postings(name, values...)
+	require.NoError(tb, err)
+	gotRefs, err := ExpandPostings(p)
+	require.NoError(tb, err)
+	require.Equal(tb, expRefs, gotRefs, "%s=%q", name, values)
+}
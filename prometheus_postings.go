@@ -15,7 +15,9 @@ package main
 
 import (
 	"container/heap"
+	"context"
 	"encoding/binary"
+	"math"
 	"runtime"
 	"sort"
 	"sync"
@@ -151,50 +153,27 @@ type PostingsStats struct {
 	NumLabelPairs           int
 }
 
-// Stats calculates the cardinality statistics from postings.
-func (p *MemPostings) Stats(label string) *PostingsStats {
-	const maxNumOfRecords = 10
-	var size uint64
+// Stats calculates the cardinality statistics from postings, keeping the
+// limit largest of each. The values of label are reported as metrics.
+func (p *MemPostings) Stats(label string, limit int) *PostingsStats {
+	s := newStatsBuilder(label, limit)
 
 	p.mtx.RLock()
-
-	metrics := &maxHeap{}
-	labels := &maxHeap{}
-	labelValueLength := &maxHeap{}
-	labelValuePairs := &maxHeap{}
-	numLabelPairs := 0
-
-	metrics.init(maxNumOfRecords)
-	labels.init(maxNumOfRecords)
-	labelValueLength.init(maxNumOfRecords)
-	labelValuePairs.init(maxNumOfRecords)
-
 	for n, e := range p.m {
 		if n == "" {
 			continue
 		}
-		labels.push(Stat{Name: n, Count: uint64(len(e))})
-		numLabelPairs += len(e)
-		size = 0
-		for name, values := range e {
-			if n == label {
-				metrics.push(Stat{Name: name, Count: uint64(len(values))})
-			}
-			labelValuePairs.push(Stat{Name: n + "=" + name, Count: uint64(len(values))})
-			size += uint64(len(name))
+		values := make([]string, 0, len(e))
+		counts := make([]uint64, 0, len(e))
+		for value, refs := range e {
+			values = append(values, value)
+			counts = append(counts, uint64(len(refs)))
 		}
-		labelValueLength.push(Stat{Name: n, Count: size})
+		s.addLabel(n, values, counts)
 	}
-
 	p.mtx.RUnlock()
 
-	return &PostingsStats{
-		CardinalityMetricsStats: metrics.get(),
-		CardinalityLabelStats:   labels.get(),
-		LabelValueStats:         labelValueLength.get(),
-		LabelValuePairsStats:    labelValuePairs.get(),
-		NumLabelPairs:           numLabelPairs,
-	}
+	return s.get()
 }
 
 // Get returns a postings list for the given label pair.
@@ -443,6 +422,9 @@ func Intersect(its ...Postings) Postings {
 			return EmptyPostings()
 		}
 	}
+	if bs, ok := unreadBitmaps(its); ok {
+		return newBitmapPostings(roaringIntersect(bs...))
+	}
 
 	return newIntersectPostings(its...)
 }
@@ -510,6 +492,9 @@ func Merge(its ...Postings) Postings {
 	if len(its) == 1 {
 		return its[0]
 	}
+	if bs, ok := unreadBitmaps(its); ok {
+		return newBitmapPostings(roaringUnion(bs...))
+	}
 
 	p, ok := newMergedPostings(its)
 	if !ok {
@@ -647,6 +632,9 @@ func Without(full, drop Postings) Postings {
 	if drop == EmptyPostings() {
 		return full
 	}
+	if bs, ok := unreadBitmaps([]Postings{full, drop}); ok {
+		return newBitmapPostings(roaringWithout(bs[0], bs[1]))
+	}
 	return newRemovedPostings(full, drop)
 }
 
@@ -723,6 +711,117 @@ func (rp *removedPostings) Err() error {
 	return rp.remove.Err()
 }
 
+// checkContextEveryNIterations is how many calls of Next and Seek pass between
+// two checks of the context of contextPostings, to keep its overhead low.
+const checkContextEveryNIterations = 128
+
+// contextPostings stops iterating once its context is done, reporting the
+// context error through Err.
+type contextPostings struct {
+	ctx context.Context
+	p   Postings
+	n   int
+	err error
+}
+
+// NewContextPostings returns postings over p that stop with ctx.Err() as their
+// error once ctx is done. The context is checked on the first call of Next or
+// Seek, and periodically after that.
+func NewContextPostings(ctx context.Context, p Postings) Postings {
+	if p == EmptyPostings() {
+		return p
+	}
+	return &contextPostings{ctx: ctx, p: p}
+}
+
+func (c *contextPostings) done() bool {
+	if c.err != nil {
+		return true
+	}
+	if c.n%checkContextEveryNIterations == 0 {
+		c.err = c.ctx.Err()
+	}
+	c.n++
+	return c.err != nil
+}
+
+func (c *contextPostings) Next() bool {
+	if c.done() {
+		return false
+	}
+	return c.p.Next()
+}
+
+func (c *contextPostings) Seek(id storage.SeriesRef) bool {
+	if c.done() {
+		return false
+	}
+	return c.p.Seek(id)
+}
+
+func (c *contextPostings) At() storage.SeriesRef {
+	return c.p.At()
+}
+
+func (c *contextPostings) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.p.Err()
+}
+
+// withContext wraps all postings into contextPostings, so that operations
+// over them stop within a bounded number of steps once ctx is done.
+func withContext(ctx context.Context, its []Postings) []Postings {
+	res := make([]Postings, 0, len(its))
+	for _, p := range its {
+		res = append(res, NewContextPostings(ctx, p))
+	}
+	return res
+}
+
+// IntersectContext is like Intersect, but the returned postings stop with
+// ctx.Err() as their error once ctx is done.
+func IntersectContext(ctx context.Context, its ...Postings) Postings {
+	if err := ctx.Err(); err != nil {
+		return ErrPostings(err)
+	}
+	if bs, ok := unreadBitmaps(its); ok && len(its) > 1 {
+		return NewContextPostings(ctx, newBitmapPostings(roaringIntersect(bs...)))
+	}
+	return Intersect(withContext(ctx, its)...)
+}
+
+// MergeContext is like Merge, but the returned postings stop with ctx.Err()
+// as their error once ctx is done.
+func MergeContext(ctx context.Context, its ...Postings) Postings {
+	if err := ctx.Err(); err != nil {
+		return ErrPostings(err)
+	}
+	if bs, ok := unreadBitmaps(its); ok && len(its) > 1 {
+		return NewContextPostings(ctx, newBitmapPostings(roaringUnion(bs...)))
+	}
+	return Merge(withContext(ctx, its)...)
+}
+
+// WithoutContext is like Without, but the returned postings stop with
+// ctx.Err() as their error once ctx is done.
+func WithoutContext(ctx context.Context, full, drop Postings) Postings {
+	if err := ctx.Err(); err != nil {
+		return ErrPostings(err)
+	}
+	if bs, ok := unreadBitmaps([]Postings{full, drop}); ok {
+		return NewContextPostings(ctx, newBitmapPostings(roaringWithout(bs[0], bs[1])))
+	}
+	return Without(NewContextPostings(ctx, full), NewContextPostings(ctx, drop))
+}
+
+// ExpandPostingsContext is like ExpandPostings, but stops with ctx.Err() once
+// ctx is done.
+func ExpandPostingsContext(ctx context.Context, p Postings) ([]storage.SeriesRef, error) {
+	return ExpandPostings(NewContextPostings(ctx, p))
+}
+
 // ListPostings implements the Postings interface over a plain list.
 type ListPostings struct {
 	list []storage.SeriesRef
@@ -805,6 +904,11 @@ func (it *bigEndianPostings) Seek(x storage.SeriesRef) bool {
 	if storage.SeriesRef(it.cur) >= x {
 		return true
 	}
+	if x > math.MaxUint32 {
+		// No 4 byte reference can satisfy this.
+		it.list = nil
+		return false
+	}
 
 	num := len(it.list) / 4
 	// Do binary search between current position and end.
@@ -825,6 +929,54 @@ func (it *bigEndianPostings) Err() error {
 	return nil
 }
 
+// bigEndian64Postings implements the Postings interface over a byte stream of
+// 8 byte big endian numbers.
+type bigEndian64Postings struct {
+	list []byte
+	cur  uint64
+}
+
+func newBigEndian64Postings(list []byte) *bigEndian64Postings {
+	return &bigEndian64Postings{list: list}
+}
+
+func (it *bigEndian64Postings) At() storage.SeriesRef {
+	return storage.SeriesRef(it.cur)
+}
+
+func (it *bigEndian64Postings) Next() bool {
+	if len(it.list) >= 8 {
+		it.cur = binary.BigEndian.Uint64(it.list)
+		it.list = it.list[8:]
+		return true
+	}
+	return false
+}
+
+func (it *bigEndian64Postings) Seek(x storage.SeriesRef) bool {
+	if storage.SeriesRef(it.cur) >= x {
+		return true
+	}
+
+	num := len(it.list) / 8
+	// Do binary search between current position and end.
+	i := sort.Search(num, func(i int) bool {
+		return binary.BigEndian.Uint64(it.list[i*8:]) >= uint64(x)
+	})
+	if i < num {
+		j := i * 8
+		it.cur = binary.BigEndian.Uint64(it.list[j:])
+		it.list = it.list[j+8:]
+		return true
+	}
+	it.list = nil
+	return false
+}
+
+func (it *bigEndian64Postings) Err() error {
+	return nil
+}
+
 // seriesRefSlice attaches the methods of sort.Interface to []storage.SeriesRef, sorting in increasing order.
 type seriesRefSlice []storage.SeriesRef
 
@@ -14,8 +14,13 @@
 package main
 
 import (
-	"math"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
 	"sort"
+
+	"github.com/pkg/errors"
 )
 
 // Stat holds values for a single cardinality statistic.
@@ -24,46 +29,174 @@ type Stat struct {
 	Count uint64
 }
 
-type maxHeap struct {
-	maxLength int
-	minValue  uint64
-	minIndex  int
-	Items     []Stat
+// statLess orders stats by count, and those with equal counts by name in
+// reverse, so that the top stats do not depend on the order they are seen in.
+func statLess(a, b Stat) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return a.Name > b.Name
 }
 
-func (m *maxHeap) init(len int) {
-	m.maxLength = len
-	m.minValue = math.MaxUint64
-	m.Items = make([]Stat, 0, len)
+// topK keeps the k largest stats pushed to it. It is a min-heap, so that the
+// smallest of the kept stats can be replaced in logarithmic time.
+type topK struct {
+	k     int
+	Items []Stat
 }
 
-func (m *maxHeap) push(item Stat) {
-	if len(m.Items) < m.maxLength {
-		if item.Count < m.minValue {
-			m.minValue = item.Count
-			m.minIndex = len(m.Items)
-		}
-		m.Items = append(m.Items, item)
+// newTopK returns a topK keeping the k largest stats, or none if k is negative.
+func newTopK(k int) *topK {
+	if k < 0 {
+		k = 0
+	}
+	return &topK{k: k, Items: make([]Stat, 0, k)}
+}
+
+func (t topK) Len() int            { return len(t.Items) }
+func (t topK) Less(i, j int) bool  { return statLess(t.Items[i], t.Items[j]) }
+func (t topK) Swap(i, j int)       { t.Items[i], t.Items[j] = t.Items[j], t.Items[i] }
+func (t *topK) Push(x interface{}) { t.Items = append(t.Items, x.(Stat)) }
+
+func (t *topK) Pop() interface{} {
+	old := t.Items
+	n := len(old)
+	x := old[n-1]
+	t.Items = old[0 : n-1]
+	return x
+}
+
+func (t *topK) push(item Stat) {
+	if t.k <= 0 {
 		return
 	}
-	if item.Count < m.minValue {
+	if len(t.Items) < t.k {
+		heap.Push(t, item)
 		return
 	}
+	if !statLess(t.Items[0], item) {
+		return
+	}
+	t.Items[0] = item
+	heap.Fix(t, 0)
+}
+
+// get returns the kept stats, largest first.
+func (t *topK) get() []Stat {
+	sort.Slice(t.Items, func(i, j int) bool { return statLess(t.Items[j], t.Items[i]) })
+	return t.Items
+}
+
+// statsBuilder computes PostingsStats from the postings counts of all label
+// pairs, which it is given one at a time.
+type statsBuilder struct {
+	label string
+
+	metrics          *topK
+	labels           *topK
+	labelValueLength *topK
+	labelValuePairs  *topK
+	numLabelPairs    int
+}
+
+func newStatsBuilder(label string, limit int) *statsBuilder {
+	return &statsBuilder{
+		label:            label,
+		metrics:          newTopK(limit),
+		labels:           newTopK(limit),
+		labelValueLength: newTopK(limit),
+		labelValuePairs:  newTopK(limit),
+	}
+}
+
+// addLabel adds the postings counts of the values of a label name.
+func (s *statsBuilder) addLabel(name string, values []string, counts []uint64) {
+	s.labels.push(Stat{Name: name, Count: uint64(len(values))})
+	s.numLabelPairs += len(values)
+	var size uint64
+	for i, value := range values {
+		if name == s.label {
+			s.metrics.push(Stat{Name: value, Count: counts[i]})
+		}
+		s.labelValuePairs.push(Stat{Name: name + "=" + value, Count: counts[i]})
+		size += uint64(len(value))
+	}
+	s.labelValueLength.push(Stat{Name: name, Count: size})
+}
+
+func (s *statsBuilder) get() *PostingsStats {
+	return &PostingsStats{
+		CardinalityMetricsStats: s.metrics.get(),
+		CardinalityLabelStats:   s.labels.get(),
+		LabelValueStats:         s.labelValueLength.get(),
+		LabelValuePairsStats:    s.labelValuePairs.get(),
+		NumLabelPairs:           s.numLabelPairs,
+	}
+}
 
-	m.Items[m.minIndex] = item
-	m.minValue = item.Count
+// Stats calculates the cardinality statistics of the index, keeping the limit
+// largest of each. The values of label are reported as metrics.
+func (r *Reader) Stats(label string, limit int) (*PostingsStats, error) {
+	names, err := r.LabelNames()
+	if err != nil {
+		return nil, errors.Wrap(err, "get label names")
+	}
 
-	for i, stat := range m.Items {
-		if stat.Count < m.minValue {
-			m.minValue = stat.Count
-			m.minIndex = i
+	s := newStatsBuilder(label, limit)
+	for _, name := range names {
+		values, err := r.SortedLabelValues(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get label values of %s", name)
+		}
+		counts := make([]uint64, 0, len(values))
+		if err := r.postingsLists(name, values, func(value string, b []byte) error {
+			n, _, err := r.dec.Postings(b)
+			if err != nil {
+				return errors.Wrapf(err, "decode postings of %s=%q", name, value)
+			}
+			counts = append(counts, uint64(n))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if len(counts) != len(values) {
+			return nil, errors.Errorf("found postings for %d of %d values of %s", len(counts), len(values), name)
 		}
+		s.addLabel(name, values, counts)
 	}
+	return s.get(), nil
+}
+
+// WriteJSON writes the stats to w as JSON.
+func (s *PostingsStats) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
 }
 
-func (m *maxHeap) get() []Stat {
-	sort.Slice(m.Items, func(i, j int) bool {
-		return m.Items[i].Count > m.Items[j].Count
-	})
-	return m.Items
+// WriteTable writes the stats to w as text tables, like the TSDB status page.
+func (s *PostingsStats) WriteTable(w io.Writer) error {
+	for _, t := range []struct {
+		title string
+		stats []Stat
+	}{
+		{title: "Highest cardinality metric names", stats: s.CardinalityMetricsStats},
+		{title: "Highest cardinality labels", stats: s.CardinalityLabelStats},
+		{title: "Labels with highest cumulative label value length", stats: s.LabelValueStats},
+		{title: "Most common label pairs", stats: s.LabelValuePairsStats},
+	} {
+		if _, err := fmt.Fprintf(w, "%s:\n", t.title); err != nil {
+			return err
+		}
+		for _, stat := range t.stats {
+			if _, err := fmt.Fprintf(w, "  %-60s %10d\n", stat.Name, stat.Count); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "Label pairs: %d\n", s.NumLabelPairs)
+	return err
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopK(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, k := range []int{-1, 0, 1, 3, 10, 100} {
+		var all []Stat
+		top := newTopK(k)
+		for i := 0; i < 50; i++ {
+			s := Stat{Name: fmt.Sprintf("s%d", i), Count: uint64(rnd.Intn(20))}
+			all = append(all, s)
+			top.push(s)
+		}
+		sort.Slice(all, func(i, j int) bool { return statLess(all[j], all[i]) })
+		if k < 0 {
+			all = all[:0]
+		} else if k < len(all) {
+			all = all[:k]
+		}
+		require.Equal(t, all, top.get(), "k=%d", k)
+	}
+}
+
+func TestReaderStats(t *testing.T) {
+	be, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(t, err)
+	defer be.Close()
+	rb, err := NewFileReaderWithOptions(roaringBitmapIndexPath, ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+	require.NoError(t, err)
+	defer rb.Close()
+
+	// The stats of an index must match those of its series added to memory.
+	for _, r := range []*Reader{be, rb} {
+		mp := NewMemPostings()
+		p, err := r.Postings(AllPostingsKey())
+		require.NoError(t, err)
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		for p.Next() {
+			require.NoError(t, r.Series(p.At(), &lset, &chks))
+			mp.Add(p.At(), lset)
+		}
+		require.NoError(t, p.Err())
+
+		for _, limit := range []int{1, 10, 1000} {
+			exp := mp.Stats("__name__", limit)
+			require.NotEmpty(t, exp.CardinalityMetricsStats)
+			stats, err := r.Stats("__name__", limit)
+			require.NoError(t, err)
+			require.Equal(t, exp, stats)
+		}
+	}
+
+	// Negative limits report no entries rather than panicking.
+	stats, err := be.Stats("__name__", -1)
+	require.NoError(t, err)
+	require.Empty(t, stats.CardinalityMetricsStats)
+	require.Empty(t, NewMemPostings().Stats("__name__", -1).CardinalityMetricsStats)
+	require.Error(t, runStats([]string{"-limit=-1"}))
+
+	stats, err = be.Stats("job", 5)
+	require.NoError(t, err)
+	require.Len(t, stats.CardinalityLabelStats, 5)
+
+	var buf bytes.Buffer
+	require.NoError(t, stats.WriteTable(&buf))
+	require.Contains(t, buf.String(), "Most common label pairs:")
+	require.Contains(t, buf.String(), stats.LabelValuePairsStats[0].Name)
+
+	buf.Reset()
+	require.NoError(t, stats.WriteJSON(&buf))
+	var decoded PostingsStats
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, *stats, decoded)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+	"github.com/stretchr/testify/require"
+)
+
+// contextOps are the context-aware set operations, with their plain variants.
+var contextOps = []struct {
+	name  string
+	plain func(...Postings) Postings
+	ctx   func(context.Context, ...Postings) Postings
+}{
+	{name: "intersect", plain: Intersect, ctx: IntersectContext},
+	{name: "merge", plain: Merge, ctx: MergeContext},
+	{
+		name:  "without",
+		plain: func(p ...Postings) Postings { return Without(p[0], p[1]) },
+		ctx:   func(ctx context.Context, p ...Postings) Postings { return WithoutContext(ctx, p[0], p[1]) },
+	},
+}
+
+func TestContextPostings(t *testing.T) {
+	const n = 100000
+	lists := [][]uint64{make([]uint64, 0, n), make([]uint64, 0, n)}
+	for i := uint64(0); i < n; i++ {
+		lists[0] = append(lists[0], i*2)
+		lists[1] = append(lists[1], i*3)
+	}
+	inputs := map[string]func() []Postings{
+		"list": func() []Postings {
+			return []Postings{NewListPostings(toSeriesRefs(lists[0])), NewListPostings(toSeriesRefs(lists[1]))}
+		},
+		"bitmap": func() []Postings {
+			return []Postings{newBitmapPostings(newRoarBitmap(lists[0]...)), newBitmapPostings(newRoarBitmap(lists[1]...))}
+		},
+	}
+
+	for _, op := range contextOps {
+		for name, postings := range inputs {
+			t.Run(fmt.Sprintf("%s/%s", op.name, name), func(t *testing.T) {
+				exp, err := ExpandPostings(op.plain(postings()...))
+				require.NoError(t, err)
+				got, err := ExpandPostingsContext(context.Background(), op.ctx(context.Background(), postings()...))
+				require.NoError(t, err)
+				require.Equal(t, exp, got)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				p := op.ctx(ctx, postings()...)
+				require.False(t, p.Next())
+				require.Equal(t, context.Canceled, p.Err())
+
+				// Cancelling during iteration stops it shortly after.
+				ctx, cancel = context.WithCancel(context.Background())
+				p = op.ctx(ctx, postings()...)
+				for i := 0; i < 10; i++ {
+					require.True(t, p.Next())
+				}
+				cancel()
+				var rest int
+				for p.Next() {
+					rest++
+				}
+				require.Equal(t, context.Canceled, p.Err())
+				require.Less(t, rest, 2*checkContextEveryNIterations)
+			})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ExpandPostingsContext(ctx, NewListPostings([]storage.SeriesRef{1, 2, 3}))
+	require.Equal(t, context.Canceled, err)
+}
+
+func BenchmarkContextPostings(b *testing.B) {
+	// A union of many large lists, as for __name__=~".+" on a big index.
+	const numLists, listLen = 64, 100000
+	lists := make([][]storage.SeriesRef, numLists)
+	for i := range lists {
+		for j := 0; j < listLen; j++ {
+			lists[i] = append(lists[i], storage.SeriesRef(j*numLists+i))
+		}
+	}
+	postings := func() []Postings {
+		ps := make([]Postings, 0, len(lists))
+		for _, l := range lists {
+			ps = append(ps, NewListPostings(l))
+		}
+		return ps
+	}
+
+	b.Run("merge", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := ExpandPostings(Merge(postings()...))
+			require.NoError(b, err)
+		}
+	})
+	b.Run("merge_context", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := ExpandPostingsContext(context.Background(), MergeContext(context.Background(), postings()...))
+			require.NoError(b, err)
+		}
+	})
+	for _, timeout := range []time.Duration{time.Millisecond, 10 * time.Millisecond} {
+		b.Run(fmt.Sprintf("merge_timeout_%s", timeout), func(b *testing.B) {
+			var timedOut int
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				_, err := ExpandPostingsContext(ctx, MergeContext(ctx, postings()...))
+				cancel()
+				if err != nil {
+					require.Equal(b, context.DeadlineExceeded, err)
+					timedOut++
+				}
+			}
+			b.ReportMetric(float64(timedOut)/float64(b.N), "timed-out/op")
+		})
+	}
+}
+
+// fuzzInput hands out the bytes of a fuzz input as small numbers, and zeros
+// once they run out.
+type fuzzInput struct {
+	b []byte
+}
+
+func (in *fuzzInput) byte() byte {
+	if len(in.b) == 0 {
+		return 0
+	}
+	v := in.b[0]
+	in.b = in.b[1:]
+	return v
+}
+
+func (in *fuzzInput) uint16() uint16 {
+	return uint16(in.byte())<<8 | uint16(in.byte())
+}
+
+func (in *fuzzInput) intn(n int) int {
+	return int(in.byte()) % n
+}
+
+// seriesRefs returns a sorted set of series references, either sparse or in
+// dense runs, so that roaring bitmaps get both array and bitmap containers,
+// possibly spanning several of them.
+func (in *fuzzInput) seriesRefs() []uint64 {
+	var (
+		refs []uint64
+		next = uint64(in.uint16()) << in.intn(20)
+	)
+	for runs := in.intn(4); runs >= 0; runs-- {
+		switch in.intn(3) {
+		case 0:
+			for n := in.intn(64); n > 0; n-- {
+				refs = append(refs, next)
+				next += 1 + uint64(in.byte())
+			}
+		case 1:
+			step := uint64(1 + in.intn(3))
+			for n := 1 + in.intn(16)*512; n > 0; n-- {
+				refs = append(refs, next)
+				next += step
+			}
+		case 2:
+			next += uint64(in.uint16()) << in.intn(24)
+		}
+	}
+	return refs
+}
+
+// postingsImpl builds a Postings implementation over sorted references.
+type postingsImpl struct {
+	name  string
+	build func(refs []uint64) Postings
+	// maxRef is the largest reference the implementation can hold.
+	maxRef uint64
+}
+
+func (impl postingsImpl) holds(refs []uint64) bool {
+	return len(refs) == 0 || refs[len(refs)-1] <= impl.maxRef
+}
+
+func encodedPostings(tb testing.TB, codec PostingsCodec, refs []uint64, offset int) Postings {
+	var e encoding.Encbuf
+	for i := 0; i < offset; i++ {
+		e.PutByte(0)
+	}
+	require.NoError(tb, codec.EncodePostings(&e, refs))
+	n, p, err := codec.DecodePostings(e.Get()[offset:])
+	require.NoError(tb, err)
+	require.Equal(tb, len(refs), n)
+	return p
+}
+
+func postingsImpls(tb testing.TB) []postingsImpl {
+	return []postingsImpl{
+		{name: "list", maxRef: math.MaxUint64, build: func(refs []uint64) Postings { return NewListPostings(toSeriesRefs(refs)) }},
+		{name: "big_endian", maxRef: math.MaxUint32, build: func(refs []uint64) Postings {
+			return encodedPostings(tb, BigEndianPostingsCodec, refs, 0)
+		}},
+		{name: "big_endian_64", maxRef: math.MaxUint64, build: func(refs []uint64) Postings {
+			return encodedPostings(tb, BigEndian64PostingsCodec, refs, 0)
+		}},
+		{name: "roaring", maxRef: math.MaxUint64, build: func(refs []uint64) Postings {
+			return encodedPostings(tb, RoaringPostingsCodec, refs, 4)
+		}},
+		{name: "roaring_unaligned", maxRef: math.MaxUint64, build: func(refs []uint64) Postings {
+			return encodedPostings(tb, RoaringPostingsCodec, refs, 0)
+		}},
+		{name: "context", maxRef: math.MaxUint64, build: func(refs []uint64) Postings {
+			return NewContextPostings(context.Background(), NewListPostings(toSeriesRefs(refs)))
+		}},
+	}
+}
+
+// postingsModel is the reference Postings, a sorted slice with a position.
+type postingsModel struct {
+	refs []uint64
+	pos  int
+}
+
+func newPostingsModel(refs []uint64) *postingsModel {
+	return &postingsModel{refs: refs, pos: -1}
+}
+
+func (m *postingsModel) At() storage.SeriesRef { return storage.SeriesRef(m.refs[m.pos]) }
+
+func (m *postingsModel) Next() bool {
+	m.pos++
+	return m.pos < len(m.refs)
+}
+
+func (m *postingsModel) Seek(x storage.SeriesRef) bool {
+	if m.pos < 0 {
+		m.pos = 0
+	}
+	for m.pos < len(m.refs) && storage.SeriesRef(m.refs[m.pos]) < x {
+		m.pos++
+	}
+	return m.pos < len(m.refs)
+}
+
+// postingsTree is a random tree of set operations over postings, with the
+// set of references it evaluates to.
+type postingsTree struct {
+	exp   []uint64
+	build func() Postings
+}
+
+func intersectRefs(a, b []uint64) []uint64 {
+	var res []uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+func mergeRefs(a, b []uint64) []uint64 {
+	var res []uint64
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			res = append(res, a[i])
+			i++
+		case a[i] > b[j]:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
+
+func withoutRefs(a, b []uint64) []uint64 {
+	var res []uint64
+	j := 0
+	for _, x := range a {
+		for j < len(b) && b[j] < x {
+			j++
+		}
+		if j == len(b) || b[j] != x {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// postingsTree returns a random tree of set operations. Leaves are bitmaps
+// only if bitmapsOnly is set, so that the roaring fast paths are taken.
+func (in *fuzzInput) postingsTree(impls []postingsImpl, depth int, bitmapsOnly bool) postingsTree {
+	op := 0
+	if depth > 0 {
+		op = in.intn(4)
+	}
+	switch op {
+	case 1, 2:
+		children := make([]postingsTree, 1+in.intn(3))
+		for i := range children {
+			children[i] = in.postingsTree(impls, depth-1, bitmapsOnly)
+		}
+		exp := children[0].exp
+		for _, c := range children[1:] {
+			if op == 1 {
+				exp = intersectRefs(exp, c.exp)
+			} else {
+				exp = mergeRefs(exp, c.exp)
+			}
+		}
+		return postingsTree{exp: exp, build: func() Postings {
+			its := make([]Postings, 0, len(children))
+			for _, c := range children {
+				its = append(its, c.build())
+			}
+			if op == 1 {
+				return Intersect(its...)
+			}
+			return Merge(its...)
+		}}
+	case 3:
+		full := in.postingsTree(impls, depth-1, bitmapsOnly)
+		drop := in.postingsTree(impls, depth-1, bitmapsOnly)
+		return postingsTree{exp: withoutRefs(full.exp, drop.exp), build: func() Postings {
+			return Without(full.build(), drop.build())
+		}}
+	}
+
+	refs := in.seriesRefs()
+	impl := impls[in.intn(len(impls))]
+	if bitmapsOnly {
+		impl = impls[3]
+	}
+	if !impl.holds(refs) {
+		impl = impls[0]
+	}
+	return postingsTree{exp: refs, build: func() Postings { return impl.build(refs) }}
+}
+
+// checkPostings applies a random sequence of Next and Seek calls to p and to
+// the reference model over exp, and requires them to agree.
+func checkPostings(t *testing.T, in *fuzzInput, exp []uint64, p Postings) {
+	m := newPostingsModel(exp)
+	for step := 0; ; step++ {
+		var (
+			desc      string
+			got, want bool
+		)
+		if in.intn(2) == 0 {
+			desc = "Next()"
+			got, want = p.Next(), m.Next()
+		} else {
+			var x storage.SeriesRef
+			switch {
+			case len(exp) > 0 && in.intn(2) == 0:
+				x = storage.SeriesRef(exp[in.intn(len(exp))] + uint64(in.intn(2)))
+			case m.pos >= 0 && m.pos < len(exp):
+				x = storage.SeriesRef(exp[m.pos]) + storage.SeriesRef(in.uint16())
+			default:
+				x = storage.SeriesRef(in.uint16()) << in.intn(24)
+			}
+			// Postings start at 0 and so report any reference seeked to
+			// before the first call to Next or Seek as found.
+			if m.pos < 0 && x == 0 {
+				x = 1
+			}
+			desc = fmt.Sprintf("Seek(%d)", x)
+			got, want = p.Seek(x), m.Seek(x)
+		}
+		require.Equal(t, want, got, "step %d: %s", step, desc)
+		if !want {
+			break
+		}
+		require.Equal(t, m.At(), p.At(), "step %d: %s", step, desc)
+	}
+	require.NoError(t, p.Err())
+}
+
+func FuzzPostings(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 3, 0, 20, 1, 2, 3, 4, 5, 1, 0, 1, 1, 1, 1, 1})
+	f.Add([]byte{1, 0, 0, 4, 1, 1, 9, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1})
+	f.Add([]byte{2, 3, 1, 2, 3, 0, 255, 1, 2, 8, 0, 0, 7, 1, 1, 200, 1, 0, 1, 0, 1, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := &fuzzInput{b: data}
+		refs := in.seriesRefs()
+		ops := in.b
+		for _, impl := range postingsImpls(t) {
+			if !impl.holds(refs) {
+				continue
+			}
+			in := &fuzzInput{b: ops}
+			exp, err := ExpandPostings(impl.build(refs))
+			require.NoError(t, err, impl.name)
+			require.Equal(t, toSeriesRefs(refs), exp, impl.name)
+
+			t.Run(impl.name, func(t *testing.T) {
+				checkPostings(t, in, refs, impl.build(refs))
+			})
+		}
+	})
+}
+
+func FuzzPostingsSetOperations(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 1, 2, 0, 10, 0, 0, 3, 0, 1, 2, 0, 30, 1, 0, 5, 0, 0, 1, 1, 1, 0, 1})
+	f.Add([]byte{1, 2, 3, 1, 0, 1, 1, 2, 4, 0, 1, 2, 0, 1, 1, 3, 3, 1, 0, 0, 1, 2, 2, 1, 1, 1, 0, 1, 1})
+	f.Add([]byte{0, 3, 2, 1, 1, 0, 1, 1, 3, 1, 1, 0, 1, 7, 2, 0, 1, 2, 1, 0, 9, 1, 2, 3, 4, 5, 6, 7})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := &fuzzInput{b: data}
+		impls := postingsImpls(t)
+		tree := in.postingsTree(impls, 1+in.intn(3), in.intn(2) == 0)
+
+		exp, err := ExpandPostings(tree.build())
+		require.NoError(t, err)
+		require.Equal(t, toSeriesRefs(tree.exp), exp)
+
+		checkPostings(t, in, tree.exp, tree.build())
+	})
+}
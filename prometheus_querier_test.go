@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// testMatcherSets are evaluated against the big endian index in tests.
+var testMatcherSets = [][]*labels.Matcher{
+	{labels.MustNewMatcher(labels.MatchEqual, "job", "prometheus")},
+	{
+		labels.MustNewMatcher(labels.MatchEqual, "job", "prometheus"),
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "go_goroutines"),
+	},
+	{
+		labels.MustNewMatcher(labels.MatchEqual, "job", "demo"),
+		labels.MustNewMatcher(labels.MatchNotEqual, "__name__", "go_goroutines"),
+	},
+	{labels.MustNewMatcher(labels.MatchRegexp, "job", "demo|robust")},
+	{labels.MustNewMatcher(labels.MatchRegexp, "__name__", "go_.*")},
+	{
+		labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+"),
+		labels.MustNewMatcher(labels.MatchNotRegexp, "job", "prom.*"),
+	},
+	{labels.MustNewMatcher(labels.MatchEqual, "quantile", "")},
+	{labels.MustNewMatcher(labels.MatchNotEqual, "quantile", "")},
+	{labels.MustNewMatcher(labels.MatchEqual, "job", "missing")},
+}
+
+func TestPostingsForMatchers(t *testing.T) {
+	ir, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(t, err)
+	defer ir.Close()
+
+	p, err := ir.Postings(AllPostingsKey())
+	require.NoError(t, err)
+	refs, err := ExpandPostings(p)
+	require.NoError(t, err)
+	series := readIndexSeries(t, ir)
+
+	for _, ms := range testMatcherSets {
+		t.Run(MatchersKey(ms...), func(t *testing.T) {
+			var exp []storage.SeriesRef
+		Outer:
+			for i, s := range series {
+				for _, m := range ms {
+					if !m.Matches(s.lset.Get(m.Name)) {
+						continue Outer
+					}
+				}
+				exp = append(exp, refs[i])
+			}
+
+			p, err := PostingsForMatchers(ir, ms...)
+			require.NoError(t, err)
+			got, err := ExpandPostings(p)
+			require.NoError(t, err)
+			require.Equal(t, exp, got)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"unsafe"
+)
+
+// ReaderMemoryStats is an estimate of the heap held by an opened Reader, broken
+// down by structure. The bytes of the index itself are not included, as they
+// are usually memory mapped.
+type ReaderMemoryStats struct {
+	// PostingsOffsets is held by the sampled postings offset table: the map
+	// of label names to the sampled label values and their offsets.
+	PostingsOffsets uint64
+	// PostingsOffsetsV1 is held by the full postings offset table read for
+	// indexes of the v1 format.
+	PostingsOffsetsV1 uint64
+	// Symbols is held by the sampled offsets of the symbol table.
+	Symbols uint64
+	// NameSymbols is held by the cache of label name symbols. The label
+	// names are shared with the postings offset table and counted there.
+	NameSymbols uint64
+	// Reader is held by the Reader, its table of contents and decoder.
+	Reader uint64
+
+	// LabelNames is the number of label names, and SampledPostingsOffsets
+	// the number of label values kept in the postings offset table.
+	LabelNames             int
+	SampledPostingsOffsets int
+}
+
+// Total returns the estimated heap held by the Reader.
+func (s ReaderMemoryStats) Total() uint64 {
+	return s.PostingsOffsets + s.PostingsOffsetsV1 + s.Symbols + s.NameSymbols + s.Reader
+}
+
+// MemoryStats estimates the heap held by the Reader from the sizes of its
+// structures. Allocations are rounded up to a word, and maps are assumed to
+// allocate slots in powers of two which they keep at most 7/8 full.
+func (r *Reader) MemoryStats() ReaderMemoryStats {
+	var (
+		s           ReaderMemoryStats
+		stringSize  = uint64(unsafe.Sizeof(""))
+		offsetSize  = uint64(unsafe.Sizeof(postingOffset{}))
+		offsetsSize = uint64(unsafe.Sizeof([]postingOffset{}))
+	)
+	s.LabelNames = len(r.postings)
+	s.PostingsOffsets = mapBytes(len(r.postings), stringSize, offsetsSize)
+	for name, offs := range r.postings {
+		s.PostingsOffsets += allocBytes(len(name)) + allocBytes(len(offs)*int(offsetSize))
+		for _, o := range offs {
+			s.PostingsOffsets += allocBytes(len(o.value))
+		}
+		s.SampledPostingsOffsets += len(offs)
+	}
+
+	if r.postingsV1 != nil {
+		s.PostingsOffsetsV1 = mapBytes(len(r.postingsV1), stringSize, uint64(unsafe.Sizeof(map[string]uint64{})))
+		for _, values := range r.postingsV1 {
+			s.PostingsOffsetsV1 += mapBytes(len(values), stringSize, 8)
+			for value := range values {
+				s.PostingsOffsetsV1 += allocBytes(len(value))
+			}
+		}
+	}
+
+	s.Symbols = uint64(unsafe.Sizeof(Symbols{})) + allocBytes(cap(r.symbols.offsets)*int(unsafe.Sizeof(0)))
+	s.NameSymbols = mapBytes(len(r.nameSymbols), 4, stringSize)
+	s.Reader = uint64(unsafe.Sizeof(Reader{}) + unsafe.Sizeof(TOC{}) + unsafe.Sizeof(Decoder{}))
+	return s
+}
+
+// allocBytes returns the bytes allocated for an object of n bytes.
+func allocBytes(n int) uint64 {
+	const word = uint64(unsafe.Sizeof(uintptr(0)))
+	return (uint64(n) + word - 1) / word * word
+}
+
+// mapBytes returns the bytes allocated for a map of n entries with keys and
+// values of the given sizes.
+func mapBytes(n int, keySize, valueSize uint64) uint64 {
+	const (
+		header    = 48
+		groupSize = 8
+	)
+	slots := uint64(groupSize)
+	for slots*7/8 < uint64(n) {
+		slots *= 2
+	}
+	// Every slot also takes a control byte.
+	return header + slots*(keySize+valueSize+1)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryIndexes are the indexes in data/ with their codecs.
+var memoryIndexes = []struct {
+	path  string
+	codec PostingsCodec
+}{
+	{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+	{path: roaringBitmapIndexPath, codec: RoaringPostingsCodec},
+}
+
+// openReadersHeap opens n readers, and returns them with the heap they hold
+// per reader.
+func openReadersHeap(tb testing.TB, n int, open func() (*Reader, error)) ([]*Reader, uint64) {
+	readers := make([]*Reader, n)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := range readers {
+		r, err := open()
+		require.NoError(tb, err)
+		readers[i] = r
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return readers, (after.HeapAlloc - before.HeapAlloc) / uint64(n)
+}
+
+// openBytesReader returns a function opening readers of the index b.
+func openBytesReader(b []byte, codec PostingsCodec) func() (*Reader, error) {
+	return func() (*Reader, error) {
+		return NewReaderWithOptions(realByteSlice(b), ReaderOptions{PostingsCodec: codec})
+	}
+}
+
+// sampledPostingsOffsets returns the number of entries of the postings offset
+// table of r kept in memory with the given sampling factor.
+func sampledPostingsOffsets(tb testing.TB, r *Reader, factor int) int {
+	names, err := r.LabelNames()
+	require.NoError(tb, err)
+	// The list of all series has a single value.
+	sampled := 1
+	for _, name := range names {
+		values, err := r.SortedLabelValues(name)
+		require.NoError(tb, err)
+		// Every factor-th value and the last one.
+		sampled += (len(values) + factor - 1) / factor
+		if (len(values)-1)%factor != 0 {
+			sampled++
+		}
+	}
+	return sampled
+}
+
+func TestReaderMemoryStats(t *testing.T) {
+	for _, idx := range memoryIndexes {
+		t.Run(idx.codec.Name(), func(t *testing.T) {
+			b, err := ioutil.ReadFile(idx.path)
+			require.NoError(t, err)
+			readers, heap := openReadersHeap(t, 20, openBytesReader(b, idx.codec))
+			r := readers[0]
+			stats := r.MemoryStats()
+
+			names, err := r.LabelNames()
+			require.NoError(t, err)
+			// The names include the one of the list of all series.
+			require.Equal(t, len(names)+1, stats.LabelNames)
+			require.Equal(t, sampledPostingsOffsets(t, r, DefaultPostingsOffsetsFactor), stats.SampledPostingsOffsets)
+			require.Zero(t, stats.PostingsOffsetsV1)
+			require.Greater(t, stats.Symbols, uint64(r.symbols.Size()))
+
+			require.Equal(t, stats.PostingsOffsets+stats.Symbols+stats.NameSymbols+stats.Reader, stats.Total())
+			require.InEpsilon(t, float64(heap), float64(stats.Total()), 0.25, "measured %d bytes, estimated %+v", heap, stats)
+			runtime.KeepAlive(readers)
+		})
+	}
+}
+
+// BenchmarkReaderMemory measures the heap held by readers of the indexes, as
+// every block of a Prometheus server keeps one open.
+func BenchmarkReaderMemory(b *testing.B) {
+	for _, idx := range memoryIndexes {
+		b.Run(idx.codec.Name(), func(b *testing.B) {
+			data, err := ioutil.ReadFile(idx.path)
+			require.NoError(b, err)
+			b.ReportAllocs()
+			b.ResetTimer()
+			readers, heap := openReadersHeap(b, b.N, openBytesReader(data, idx.codec))
+			b.StopTimer()
+
+			stats := readers[0].MemoryStats()
+			b.ReportMetric(float64(heap), "heap-B/reader")
+			b.ReportMetric(float64(stats.Total()), "estimated-B/reader")
+			b.ReportMetric(float64(stats.PostingsOffsets), "postings-offsets-B/reader")
+			b.ReportMetric(float64(stats.Symbols), "symbols-B/reader")
+			b.ReportMetric(float64(stats.NameSymbols), "name-symbols-B/reader")
+			runtime.KeepAlive(readers)
+		})
+	}
+}
+
+// BenchmarkReaderSamplingFactors sweeps the sampling factors of the symbol and
+// postings offset tables, reporting the memory they take against the latency
+// of the lookups they speed up: Postings for the postings offsets, and Series
+// for the symbols.
+func BenchmarkReaderSamplingFactors(b *testing.B) {
+	for _, idx := range memoryIndexes {
+		data, err := ioutil.ReadFile(idx.path)
+		require.NoError(b, err)
+		r, err := NewReaderWithOptions(realByteSlice(data), ReaderOptions{PostingsCodec: idx.codec})
+		require.NoError(b, err)
+		names, err := r.LabelNames()
+		require.NoError(b, err)
+		var pairs []labels.Label
+		for _, name := range names {
+			values, err := r.SortedLabelValues(name)
+			require.NoError(b, err)
+			for _, v := range values {
+				pairs = append(pairs, labels.Label{Name: name, Value: v})
+			}
+		}
+		p, err := r.Postings(AllPostingsKey())
+		require.NoError(b, err)
+		refs, err := ExpandPostings(p)
+		require.NoError(b, err)
+
+		for _, factor := range []int{1, 4, 16, 32, 64, 256} {
+			b.Run(fmt.Sprintf("%s/postings_offsets=%d", idx.codec.Name(), factor), func(b *testing.B) {
+				r, err := NewReaderWithOptions(realByteSlice(data), ReaderOptions{PostingsCodec: idx.codec, PostingsOffsetsFactor: factor})
+				require.NoError(b, err)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					l := pairs[i%len(pairs)]
+					if _, err := r.Postings(l.Name, l.Value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(r.MemoryStats().PostingsOffsets), "postings-offsets-B")
+			})
+			b.Run(fmt.Sprintf("%s/symbols=%d", idx.codec.Name(), factor), func(b *testing.B) {
+				r, err := NewReaderWithOptions(realByteSlice(data), ReaderOptions{PostingsCodec: idx.codec, SymbolsFactor: factor})
+				require.NoError(b, err)
+				var (
+					lset labels.Labels
+					chks []chunks.Meta
+				)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := r.Series(refs[i%len(refs)], &lset, &chks); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(r.MemoryStats().Symbols), "symbols-B")
+			})
+		}
+	}
+}
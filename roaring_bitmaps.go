@@ -1,38 +1,310 @@
 package main
 
 import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sort"
+	"unsafe"
+
 	"github.com/dgraph-io/sroar"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+)
+
+// RoaringPostingsCodec writes postings as a count followed by a serialized
+// roaring bitmap, in the layout of the roaring bitmap Prometheus fork.
+// Postings lists are 8 byte aligned, so that the bitmap following the 4 byte
+// length and count can be used straight out of an mmapped index.
+var RoaringPostingsCodec PostingsCodec = roaringPostingsCodec{}
+
+type roaringPostingsCodec struct{}
+
+func (roaringPostingsCodec) Name() string { return "roaring_bitmap" }
+
+func (roaringPostingsCodec) Alignment() int { return 8 }
+
+func (roaringPostingsCodec) MaxSeriesRef() uint64 { return math.MaxUint64 }
+
+func (roaringPostingsCodec) EncodePostings(e *encoding.Encbuf, offs []uint64) error {
+	// The count is informational only, the bitmap itself holds 64 bit references.
+	e.PutBE32int(len(offs))
+	e.PutBytes(newRoarBitmap(offs...).ToBuffer())
+	return nil
+}
+
+func (roaringPostingsCodec) DecodePostings(b []byte) (int, Postings, error) {
+	d := encoding.Decbuf{B: b}
+	n := d.Be32int()
+	l := d.Get()
+	if d.Err() != nil {
+		return 0, nil, d.Err()
+	}
+	if len(l)%2 != 0 {
+		return 0, nil, errors.Errorf("unexpected roaring postings length %d, should be a multiple of 2", len(l))
+	}
+	if err := validateRoaringBuffer(l); err != nil {
+		return 0, nil, errors.Wrap(err, "invalid roaring postings")
+	}
+	return n, newBitmapPostingsFromBSlice(l), nil
+}
+
+// Layout of serialized sroar bitmaps, in 2 byte words. The buffer starts with
+// a node of 8 byte words: its size in 2 byte words, the number of keys, and
+// pairs of keys and container offsets. Each container starts with its size,
+// type and cardinality, the latter split over two words.
+const (
+	roaringArrayContainer  = 0
+	roaringBitmapContainer = 1
+	roaringContainerHeader = 4
+	roaringBitmapSize      = roaringContainerHeader + (1<<16)/16
 )
 
+// validateRoaringBuffer checks that b is a serialized sroar bitmap that can be
+// read without going out of bounds. sroar trusts its buffers entirely, and
+// sizes the results of set operations by the cardinality of the containers,
+// so the cardinality of bitmap containers is checked against their contents.
+// sroar reads buffers in native byte order, which is little endian on all
+// supported platforms.
+func validateRoaringBuffer(b []byte) error {
+	if len(b) < 8 {
+		// Read as an empty bitmap.
+		return nil
+	}
+	words := uint64(len(b) / 2)
+	nodeSize := binary.LittleEndian.Uint64(b)
+	if nodeSize%4 != 0 || nodeSize < 8 || nodeSize > words {
+		return errors.Errorf("node size %d out of bounds of %d words", nodeSize, words)
+	}
+	numKeys := binary.LittleEndian.Uint64(b[8:])
+	if maxKeys := (nodeSize/4 - 2) / 2; numKeys == 0 || numKeys > maxKeys {
+		return errors.Errorf("%d keys in a node for at most %d", numKeys, maxKeys)
+	}
+
+	var (
+		prevKey, prevEnd uint64
+		ordered          = true
+	)
+	for i := uint64(0); i < numKeys; i++ {
+		key := binary.LittleEndian.Uint64(b[16+16*i:])
+		off := binary.LittleEndian.Uint64(b[24+16*i:])
+		if key&0xffff != 0 || (i > 0 && key <= prevKey) {
+			return errors.Errorf("invalid key %d at %d", key, i)
+		}
+		prevKey = key
+		size, err := validateRoaringContainer(b, off, nodeSize, words)
+		if err != nil {
+			return err
+		}
+		if off < prevEnd {
+			ordered = false
+		}
+		prevEnd = off + size
+	}
+	if ordered {
+		return nil
+	}
+
+	// Containers are usually laid out in key order, otherwise sort them to
+	// check that they don't overlap.
+	type container struct{ off, end uint64 }
+	containers := make([]container, 0, numKeys)
+	for i := uint64(0); i < numKeys; i++ {
+		off := binary.LittleEndian.Uint64(b[24+16*i:])
+		containers = append(containers, container{off: off, end: off + uint64(binary.LittleEndian.Uint16(b[2*off:]))})
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].off < containers[j].off })
+	for i := 1; i < len(containers); i++ {
+		if containers[i-1].end > containers[i].off {
+			return errors.Errorf("overlapping containers at offsets %d and %d", containers[i-1].off, containers[i].off)
+		}
+	}
+	return nil
+}
+
+// validateRoaringContainer checks the container at the given word offset of
+// the serialized bitmap b, and returns its size in words.
+func validateRoaringContainer(b []byte, off, nodeSize, words uint64) (uint64, error) {
+	if off < nodeSize || off > words-roaringContainerHeader {
+		return 0, errors.Errorf("container offset %d out of bounds", off)
+	}
+	c := b[2*off:]
+	size := uint64(binary.LittleEndian.Uint16(c))
+	if size < roaringContainerHeader || size > words-off {
+		return 0, errors.Errorf("container size %d at offset %d out of bounds", size, off)
+	}
+	c = c[:2*size]
+	card := uint64(binary.LittleEndian.Uint16(c[4:])) + uint64(binary.LittleEndian.Uint16(c[6:]))
+	data := c[2*roaringContainerHeader:]
+
+	switch typ := binary.LittleEndian.Uint16(c[2:]); typ {
+	case roaringArrayContainer:
+		if card > size-roaringContainerHeader {
+			return 0, errors.Errorf("array container of %d words with %d elements", size, card)
+		}
+		// Like for big endian postings, the order of the elements is not
+		// checked, as that takes as long as reading them. Out of order
+		// elements give wrong results, but all operations stay in bounds.
+	case roaringBitmapContainer:
+		if size != roaringBitmapSize {
+			return 0, errors.Errorf("bitmap container of %d words", size)
+		}
+		var ones int
+		for ; len(data) >= 32; data = data[32:] {
+			ones += bits.OnesCount64(binary.LittleEndian.Uint64(data)) +
+				bits.OnesCount64(binary.LittleEndian.Uint64(data[8:])) +
+				bits.OnesCount64(binary.LittleEndian.Uint64(data[16:])) +
+				bits.OnesCount64(binary.LittleEndian.Uint64(data[24:]))
+		}
+		if uint64(ones) != card {
+			return 0, errors.Errorf("bitmap container with %d elements has cardinality %d", ones, card)
+		}
+	default:
+		return 0, errors.Errorf("unknown container type %d", typ)
+	}
+	return size, nil
+}
+
+// bitmapPostings implements the Postings interface over a roaring bitmap.
 type bitmapPostings struct {
-	slice []byte
-	b     *sroar.Bitmap
+	b   *sroar.Bitmap
+	itr *sroar.Iterator
+	// The iterator signals its end with 0, which is also a valid series
+	// reference, so keep track of how many values are left instead.
+	left int
+	cur  storage.SeriesRef
 }
 
+// newBitmapPostingsFromBSlice returns postings over a serialized bitmap. The
+// bitmap is read in place if l is suitably aligned, in which case l must not
+// be modified while the postings are in use. Otherwise l is copied.
 func newBitmapPostingsFromBSlice(l []byte) *bitmapPostings {
-	return &bitmapPostings{
-		slice: l,
-		b:     sroar.FromBuffer(l),
+	if len(l) > 0 && uintptr(unsafe.Pointer(&l[0]))%8 != 0 {
+		// Indexes written by the fork only align postings to 4 bytes.
+		return newBitmapPostings(sroar.FromBufferWithCopy(l))
+	}
+	return newBitmapPostings(sroar.FromBuffer(l))
+}
+
+func newBitmapPostings(b *sroar.Bitmap) *bitmapPostings {
+	return &bitmapPostings{b: b}
+}
+
+func (it *bitmapPostings) At() storage.SeriesRef {
+	return it.cur
+}
+
+func (it *bitmapPostings) Next() bool {
+	if it.itr == nil {
+		it.itr = it.b.NewIterator()
+		it.left = it.b.GetCardinality()
+	}
+	if it.left == 0 {
+		return false
+	}
+	it.cur = storage.SeriesRef(it.itr.Next())
+	it.left--
+	return true
+}
+
+func (it *bitmapPostings) Seek(x storage.SeriesRef) bool {
+	if it.cur >= x {
+		return true
+	}
+	for it.Next() {
+		if it.cur >= x {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *bitmapPostings) Err() error {
+	return nil
+}
+
+// unreadBitmaps returns the bitmaps of the given postings if all of them are
+// bitmap postings that have not been iterated yet. Set operations over these
+// can then be done on the bitmaps directly.
+func unreadBitmaps(its []Postings) ([]*sroar.Bitmap, bool) {
+	bs := make([]*sroar.Bitmap, 0, len(its))
+	for _, p := range its {
+		bp, ok := p.(*bitmapPostings)
+		if !ok || bp.itr != nil {
+			return nil, false
+		}
+		bs = append(bs, bp.b)
 	}
+	return bs, true
 }
 
-// For now, test uint32. After success, test uint64.
 func newRoarBitmap(seriesRef ...uint64) *sroar.Bitmap {
 	return sroar.FromSortedList(seriesRef)
 }
 
+// roaringIntersect returns the intersection of the given bitmaps. None of the
+// inputs are modified, except that a single input is returned as is.
+// Bitmaps are intersected smallest first so that the intermediate result
+// shrinks as early as possible, and the intersection stops once it is empty.
 func roaringIntersect(p ...*sroar.Bitmap) *sroar.Bitmap {
-	prev := sroar.FastAnd(p[0], p[1])
-	for i := 2; i < len(p); i++ {
-		prev = sroar.FastAnd(prev, p[i])
+	switch len(p) {
+	case 0:
+		return sroar.NewBitmap()
+	case 1:
+		return p[0]
 	}
-	return prev
+
+	type sized struct {
+		b    *sroar.Bitmap
+		card int
+	}
+	s := make([]sized, 0, len(p))
+	for _, b := range p {
+		card := b.GetCardinality()
+		if card == 0 {
+			return sroar.NewBitmap()
+		}
+		s = append(s, sized{b: b, card: card})
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i].card < s[j].card })
+
+	// sroar intersects in place, so start from a copy of the smallest input.
+	res := s[0].b.Clone()
+	for _, e := range s[1:] {
+		res.And(e.b)
+		if res.IsEmpty() {
+			return sroar.NewBitmap()
+		}
+	}
+	res.Cleanup()
+	return res
 }
 
+// roaringUnion returns the union of the given bitmaps. None of the inputs are
+// modified, except that a single input is returned as is.
 func roaringUnion(p ...*sroar.Bitmap) *sroar.Bitmap {
-	prev := sroar.FastOr(p[0], p[1])
-	for i := 2; i < len(p); i++ {
-		prev = sroar.FastOr(prev, p[i])
+	switch len(p) {
+	case 0:
+		return sroar.NewBitmap()
+	case 1:
+		return p[0]
 	}
-	return prev
+	// FastOr sizes the containers of the result from all inputs up front and
+	// merges them in a single pass, instead of growing a pairwise fold.
+	return sroar.FastOr(p...)
+}
+
+// roaringWithout returns the elements of full that are not in drop. Neither
+// input is modified.
+func roaringWithout(full, drop *sroar.Bitmap) *sroar.Bitmap {
+	// sroar's AndNot corrupts the array containers it subtracts a bitmap
+	// container from. The elements in common have array containers wherever
+	// full has, so subtracting them instead avoids that case.
+	common := full.Clone()
+	common.And(drop)
+	res := full.Clone()
+	res.AndNot(common)
+	res.Cleanup()
+	return res
 }
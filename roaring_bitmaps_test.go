@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/sroar"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+	"github.com/stretchr/testify/require"
+)
+
+func toSeriesRefs(ids []uint64) []storage.SeriesRef {
+	var refs []storage.SeriesRef
+	for _, id := range ids {
+		refs = append(refs, storage.SeriesRef(id))
+	}
+	return refs
+}
+
+func TestRoaringSetOperations(t *testing.T) {
+	cases := []struct {
+		name   string
+		inputs [][]uint64
+	}{
+		{name: "no inputs"},
+		{name: "single input", inputs: [][]uint64{{1, 5, 9}}},
+		{name: "single empty input", inputs: [][]uint64{{}}},
+		{name: "two overlapping", inputs: [][]uint64{{1, 2, 3, 4}, {2, 4, 6}}},
+		{name: "disjoint", inputs: [][]uint64{{1, 3, 5}, {2, 4, 6}, {1, 2}}},
+		{name: "with empty input", inputs: [][]uint64{{1, 2, 3}, {}, {2, 3}}},
+		{name: "smallest last", inputs: [][]uint64{{1, 2, 3, 4, 5, 6, 7, 8}, {2, 4, 6, 8}, {4, 8}}},
+		{name: "across containers", inputs: [][]uint64{{1, 1 << 16, 1<<16 + 5, 1 << 20}, {1 << 16, 1 << 20, 1 << 30}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bitmaps := make([]*sroar.Bitmap, 0, len(c.inputs))
+			lists := make([]Postings, 0, len(c.inputs))
+			for _, in := range c.inputs {
+				bitmaps = append(bitmaps, newRoarBitmap(in...))
+			}
+
+			for _, in := range c.inputs {
+				lists = append(lists, newListPostings(toSeriesRefs(in)...))
+			}
+			exp, err := ExpandPostings(Intersect(lists...))
+			require.NoError(t, err)
+			got := roaringIntersect(bitmaps...)
+			require.Equal(t, len(exp), got.GetCardinality())
+			require.Equal(t, exp, toSeriesRefs(got.ToArray()))
+
+			lists = lists[:0]
+			for _, in := range c.inputs {
+				lists = append(lists, newListPostings(toSeriesRefs(in)...))
+			}
+			exp, err = ExpandPostings(Merge(lists...))
+			require.NoError(t, err)
+			got = roaringUnion(bitmaps...)
+			require.Equal(t, len(exp), got.GetCardinality())
+			require.Equal(t, exp, toSeriesRefs(got.ToArray()))
+
+			// The inputs must be left untouched.
+			for i, in := range c.inputs {
+				require.Equal(t, len(in), bitmaps[i].GetCardinality())
+			}
+		})
+	}
+}
+
+func TestRoaringWithout(t *testing.T) {
+	// Every other element of the first container, which sroar keeps as a
+	// bitmap container.
+	var dense []uint64
+	for i := uint64(0); i < 1<<16; i += 2 {
+		dense = append(dense, i)
+	}
+	var sparse []uint64
+	for i := uint64(0); i < 100; i++ {
+		sparse = append(sparse, i*7)
+	}
+	sparse = append(sparse, 1<<16+3, 1<<20)
+
+	for _, c := range []struct {
+		name       string
+		full, drop []uint64
+	}{
+		{name: "empty", full: nil, drop: []uint64{1, 2}},
+		{name: "nothing dropped", full: []uint64{1, 2, 3}, drop: nil},
+		{name: "arrays", full: []uint64{1, 2, 3, 1 << 16, 1 << 20}, drop: []uint64{2, 1 << 20, 1 << 30}},
+		{name: "array without bitmap", full: sparse, drop: dense},
+		{name: "bitmap without array", full: dense, drop: sparse},
+		{name: "bitmap without bitmap", full: dense, drop: dense[len(dense)/2:]},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			full, drop := newRoarBitmap(c.full...), newRoarBitmap(c.drop...)
+			exp, err := ExpandPostings(Without(
+				newListPostings(toSeriesRefs(c.full)...),
+				newListPostings(toSeriesRefs(c.drop)...),
+			))
+			require.NoError(t, err)
+			got, err := ExpandPostings(newBitmapPostings(roaringWithout(full, drop)))
+			require.NoError(t, err)
+			require.Equal(t, exp, got)
+
+			// The inputs must be left untouched.
+			require.Equal(t, len(c.full), full.GetCardinality())
+			require.Equal(t, len(c.drop), drop.GetCardinality())
+		})
+	}
+}
+
+func BenchmarkRoaringSetOperations(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8} {
+		seriesIds := make([][]uint32, n)
+		for i := range seriesIds {
+			seriesIds[i] = generateSeriesIds(1+i, 1000000, 2+i)
+		}
+		bitmaps := make([]*sroar.Bitmap, n)
+		for i := range seriesIds {
+			ids := make([]uint64, 0, len(seriesIds[i]))
+			for _, id := range seriesIds[i] {
+				ids = append(ids, uint64(id))
+			}
+			bitmaps[i] = newRoarBitmap(ids...)
+		}
+		encoded := make([][]byte, n)
+		for i := range seriesIds {
+			encoded[i] = getBigEndianPostings(seriesIds[i]).list
+		}
+		bigEndian := func() []Postings {
+			ps := make([]Postings, 0, n)
+			for i := range encoded {
+				ps = append(ps, newBigEndianPostings(encoded[i]))
+			}
+			return ps
+		}
+
+		b.Run(fmt.Sprintf("intersect_big_endian_%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := ExpandPostings(Intersect(bigEndian()...))
+				require.NoError(b, err)
+			}
+		})
+		b.Run(fmt.Sprintf("intersect_roaring_%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				roaringIntersect(bitmaps...)
+			}
+		})
+		b.Run(fmt.Sprintf("union_big_endian_%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := ExpandPostings(Merge(bigEndian()...))
+				require.NoError(b, err)
+			}
+		})
+		b.Run(fmt.Sprintf("union_roaring_%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				roaringUnion(bitmaps...)
+			}
+		})
+	}
+}
+
+func FuzzRoaringSetOperations(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{2, 0, 1, 0, 0, 10, 1, 0, 1, 2, 0, 1, 1, 0, 9})
+	f.Add([]byte{1, 0, 9, 0, 1, 1, 15, 0, 2, 0, 1, 0, 1, 1, 3, 0, 1, 1, 5})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		in := &fuzzInput{b: data}
+		inputs := make([][]uint64, in.intn(4))
+		bitmaps := make([]*sroar.Bitmap, 0, len(inputs))
+		for i := range inputs {
+			inputs[i] = in.seriesRefs()
+			bitmaps = append(bitmaps, newRoarBitmap(inputs[i]...))
+		}
+
+		var intersection, union []uint64
+		for i, refs := range inputs {
+			if i == 0 {
+				intersection, union = refs, refs
+				continue
+			}
+			intersection = intersectRefs(intersection, refs)
+			union = mergeRefs(union, refs)
+		}
+		require.Equal(t, intersection, nonNil(roaringIntersect(bitmaps...).ToArray()), "intersect")
+		require.Equal(t, union, nonNil(roaringUnion(bitmaps...).ToArray()), "union")
+		if len(inputs) == 2 {
+			require.Equal(t, withoutRefs(inputs[0], inputs[1]), nonNil(roaringWithout(bitmaps[0], bitmaps[1]).ToArray()), "without")
+		}
+
+		// The inputs must be left untouched.
+		for i, refs := range inputs {
+			require.Equal(t, refs, nonNil(bitmaps[i].ToArray()))
+		}
+	})
+}
+
+// nonNil returns nil for empty refs, as the reference set operations do.
+func nonNil(refs []uint64) []uint64 {
+	if len(refs) == 0 {
+		return nil
+	}
+	return refs
+}
+
+func FuzzRoaringDecodePostings(f *testing.F) {
+	for _, refs := range [][]uint64{{}, {1, 5, 9}, {1, 1 << 16, 1 << 20}} {
+		var e encoding.Encbuf
+		require.NoError(f, RoaringPostingsCodec.EncodePostings(&e, refs))
+		f.Add(e.Get())
+	}
+	var e encoding.Encbuf
+	dense := make([]uint64, 0, 5000)
+	for i := uint64(0); i < 5000; i++ {
+		dense = append(dense, 2*i)
+	}
+	require.NoError(f, RoaringPostingsCodec.EncodePostings(&e, dense))
+	f.Add(e.Get())
+
+	other := newRoarBitmap(0, 2, 4, 1<<16, 1<<16+1, 1<<20)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Postings lists are read from 8 byte aligned positions of the index.
+		aligned := make([]byte, len(b)+8)[4:]
+		copy(aligned, b)
+		_, p, err := RoaringPostingsCodec.DecodePostings(aligned[:len(b)])
+		if err != nil {
+			return
+		}
+		bp := p.(*bitmapPostings)
+		for _, res := range []*sroar.Bitmap{
+			roaringIntersect(bp.b, other),
+			roaringUnion(bp.b, other),
+			roaringWithout(bp.b, other),
+			roaringWithout(other, bp.b),
+		} {
+			_ = res.ToArray()
+		}
+		for i := 0; i < 1000 && p.Next(); i++ {
+			p.Seek(p.At() + 3)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/encoding"
+)
+
+// SeriesEntry is a series decoded by SeriesFor.
+type SeriesEntry struct {
+	Ref    storage.SeriesRef
+	Labels labels.Labels
+	Chunks []chunks.Meta
+}
+
+// SeriesBatch decodes the series of postings lists. Label symbols are looked
+// up once per batch and their strings shared by all series, and the labels and
+// chunks of the series are laid out in slices reused by every call, so that
+// decoding many series takes a few allocations rather than a few per series.
+type SeriesBatch struct {
+	r   *Reader
+	dec Decoder
+	// symbols caches looked up symbols, up to maxSymbols of them.
+	symbols    map[uint32]string
+	maxSymbols int
+
+	series []SeriesEntry
+	lbls   []labels.Label
+	chks   []chunks.Meta
+	// Each series is decoded into lset and seriesChks first.
+	lset       labels.Labels
+	seriesChks []chunks.Meta
+}
+
+// maxSeriesBatchSymbols is the number of symbols a SeriesBatch caches.
+const maxSeriesBatchSymbols = 1 << 16
+
+// NewSeriesBatch returns a SeriesBatch decoding series of r.
+func (r *Reader) NewSeriesBatch() *SeriesBatch {
+	b := &SeriesBatch{
+		r:          r,
+		symbols:    map[uint32]string{},
+		maxSymbols: maxSeriesBatchSymbols,
+	}
+	b.dec = Decoder{LookupSymbol: b.lookupSymbol, Codec: r.dec.Codec}
+	return b
+}
+
+// SeriesFor returns the series of the postings p, in the order of p. The
+// series are only valid until the next call of SeriesFor on the batch.
+func (b *SeriesBatch) SeriesFor(p Postings) ([]SeriesEntry, error) {
+	return b.SeriesForFunc(p, nil)
+}
+
+// SeriesForFunc returns the series of the postings p for which keep returns
+// true, in the order of p, as SeriesFor does. Series are filtered as they are
+// decoded, so the ones left out are not kept meanwhile. A nil keep keeps all
+// series.
+func (b *SeriesBatch) SeriesForFunc(p Postings, keep func(labels.Labels, []chunks.Meta) bool) ([]SeriesEntry, error) {
+	b.series, b.lbls, b.chks = b.series[:0], b.lbls[:0], b.chks[:0]
+	lset, chks := &b.lset, &b.seriesChks
+	for p.Next() {
+		ref := p.At()
+		offset, err := b.r.seriesOffset(ref)
+		if err != nil {
+			return nil, err
+		}
+		d := encoding.NewDecbufUvarintAt(b.r.b, offset, castagnoliTable)
+		if d.Err() != nil {
+			return nil, d.Err()
+		}
+		if err := b.dec.Series(d.Get(), lset, chks); err != nil {
+			return nil, errors.Wrapf(err, "read series %d", ref)
+		}
+		if keep != nil && !keep(*lset, *chks) {
+			continue
+		}
+		b.lbls = append(b.lbls, *lset...)
+		b.chks = append(b.chks, *chks...)
+		// Labels and chunks are set once all series are decoded, as the
+		// slices they are laid out in grow meanwhile.
+		b.series = append(b.series, SeriesEntry{
+			Ref:    ref,
+			Labels: labels.Labels(b.lbls[len(b.lbls)-len(*lset):]),
+			Chunks: b.chks[len(b.chks)-len(*chks):],
+		})
+	}
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+
+	lbls, metas := b.lbls, b.chks
+	for i := range b.series {
+		s := &b.series[i]
+		n, m := len(s.Labels), len(s.Chunks)
+		s.Labels, lbls = labels.Labels(lbls[:n:n]), lbls[n:]
+		s.Chunks, metas = metas[:m:m], metas[m:]
+	}
+	return b.series, nil
+}
+
+// lookupSymbol looks up the symbol o, once per batch unless the cache of
+// symbols is full. A full cache is cleared, so that reused batches hold the
+// symbols of recent calls rather than of all of them.
+func (b *SeriesBatch) lookupSymbol(o uint32) (string, error) {
+	if s, ok := b.symbols[o]; ok {
+		return s, nil
+	}
+	s, err := b.r.lookupSymbol(o)
+	if err != nil {
+		return "", err
+	}
+	if len(b.symbols) >= b.maxSymbols {
+		for cached := range b.symbols {
+			delete(b.symbols, cached)
+		}
+	}
+	b.symbols[o] = s
+	return s, nil
+}
+
+// SeriesFor returns the series of the postings p, in the order of p, decoded by
+// a new SeriesBatch.
+func (r *Reader) SeriesFor(p Postings) ([]SeriesEntry, error) {
+	return r.NewSeriesBatch().SeriesFor(p)
+}
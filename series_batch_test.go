@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/stretchr/testify/require"
+)
+
+// requireSeriesEntries requires that the series are the ones of Series for refs.
+func requireSeriesEntries(tb testing.TB, r *Reader, refs []storage.SeriesRef, series []SeriesEntry) {
+	require.Len(tb, series, len(refs))
+	for i, ref := range refs {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+		)
+		require.NoError(tb, r.Series(ref, &lset, &chks))
+		require.Equal(tb, ref, series[i].Ref)
+		require.Equal(tb, lset, series[i].Labels)
+		if len(chks) == 0 {
+			require.Empty(tb, series[i].Chunks)
+			continue
+		}
+		require.Equal(tb, chks, series[i].Chunks)
+	}
+}
+
+func TestSeriesFor(t *testing.T) {
+	series := generateIndexSeries(10, 1000)
+	path := filepath.Join(t.TempDir(), "index")
+	writeIndex(t, path, RoaringPostingsCodec, indexSymbols(series), series)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: roaringBitmapIndexPath, codec: RoaringPostingsCodec},
+		{path: path, codec: RoaringPostingsCodec},
+	} {
+		t.Run(c.path, func(t *testing.T) {
+			r, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+			require.NoError(t, err)
+			defer r.Close()
+			p, err := r.Postings(AllPostingsKey())
+			require.NoError(t, err)
+			refs, err := ExpandPostings(p)
+			require.NoError(t, err)
+
+			got, err := r.SeriesFor(NewListPostings(refs))
+			require.NoError(t, err)
+			requireSeriesEntries(t, r, refs, got)
+
+			// Appending to the labels of a series leaves the next one as is.
+			if len(got) > 1 {
+				next := got[1].Labels.Copy()
+				_ = append(got[0].Labels, labels.Label{Name: "a", Value: "b"})
+				require.Equal(t, next, got[1].Labels)
+			}
+
+			// Batches are reused for later calls, which decode every
+			// other series without allocating.
+			b := r.NewSeriesBatch()
+			for i := 0; i < 2; i++ {
+				got, err := b.SeriesFor(NewListPostings(refs))
+				require.NoError(t, err)
+				requireSeriesEntries(t, r, refs, got)
+			}
+			var every []storage.SeriesRef
+			for i := 0; i < len(refs); i += 2 {
+				every = append(every, refs[i])
+			}
+			got, err = b.SeriesFor(NewListPostings(every))
+			require.NoError(t, err)
+			requireSeriesEntries(t, r, every, got)
+			allocs := testing.AllocsPerRun(10, func() {
+				_, err := b.SeriesFor(NewListPostings(every))
+				require.NoError(t, err)
+			})
+			require.LessOrEqual(t, allocs, 2.0)
+
+			got, err = b.SeriesFor(EmptyPostings())
+			require.NoError(t, err)
+			require.Empty(t, got)
+
+			// The symbols cache is cleared once full.
+			b = r.NewSeriesBatch()
+			b.maxSymbols = 8
+			for i := 0; i < 2; i++ {
+				got, err := b.SeriesFor(NewListPostings(refs))
+				require.NoError(t, err)
+				requireSeriesEntries(t, r, refs, got)
+				require.LessOrEqual(t, len(b.symbols), b.maxSymbols)
+			}
+
+			// Series are filtered as they are decoded.
+			got, err = b.SeriesForFunc(NewListPostings(refs), func(lset labels.Labels, _ []chunks.Meta) bool {
+				return lset.Hash()%2 == 0
+			})
+			require.NoError(t, err)
+			var kept []storage.SeriesRef
+			for _, ref := range refs {
+				var (
+					lset labels.Labels
+					chks []chunks.Meta
+				)
+				require.NoError(t, r.Series(ref, &lset, &chks))
+				if lset.Hash()%2 == 0 {
+					kept = append(kept, ref)
+				}
+			}
+			require.NotEmpty(t, kept)
+			requireSeriesEntries(t, r, kept, got)
+		})
+	}
+}
+
+func TestSeriesForErrors(t *testing.T) {
+	r, err := NewFileReaderWithOptions(bigEndianIndexPath, ReaderOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.SeriesFor(NewListPostings([]storage.SeriesRef{math.MaxUint64}))
+	require.Error(t, err)
+	_, err = r.SeriesFor(NewListPostings([]storage.SeriesRef{1}))
+	require.Error(t, err)
+	_, err = r.SeriesFor(ErrPostings(errors.New("postings")))
+	require.EqualError(t, err, "postings")
+}
+
+// BenchmarkSeriesFor measures getting the labels of the series selected by
+// each query of the workload, from matchers to labels, with a Series call per
+// series as by the API before, and with a reused SeriesBatch.
+func BenchmarkSeriesFor(b *testing.B) {
+	queries := loadBenchQueries(b)
+	for _, idx := range memoryIndexes {
+		r, err := NewFileReaderWithOptions(idx.path, ReaderOptions{PostingsCodec: idx.codec})
+		require.NoError(b, err)
+
+		for i, q := range queries {
+			p, err := PostingsForMatchers(r, q.Matchers...)
+			require.NoError(b, err)
+			refs, err := ExpandPostings(p)
+			require.NoError(b, err)
+
+			batch := r.NewSeriesBatch()
+			for _, c := range []struct {
+				name   string
+				series func(p Postings) (int, error)
+			}{
+				{name: "series", series: func(p Postings) (int, error) {
+					var (
+						res  []labels.Labels
+						chks []chunks.Meta
+					)
+					for p.Next() {
+						var lset labels.Labels
+						if err := r.Series(p.At(), &lset, &chks); err != nil {
+							return 0, err
+						}
+						res = append(res, lset)
+					}
+					return len(res), p.Err()
+				}},
+				{name: "batch", series: func(p Postings) (int, error) {
+					res, err := batch.SeriesFor(p)
+					return len(res), err
+				}},
+			} {
+				b.Run(fmt.Sprintf("%s/query=%d/%s", idx.codec.Name(), i+1, c.name), func(b *testing.B) {
+					b.ReportAllocs()
+					for n := 0; n < b.N; n++ {
+						p, err := PostingsForMatchers(r, q.Matchers...)
+						if err != nil {
+							b.Fatal(err)
+						}
+						if _, err := c.series(p); err != nil {
+							b.Fatal(err)
+						}
+					}
+					b.ReportMetric(float64(len(refs)), "series")
+				})
+			}
+		}
+		require.NoError(b, r.Close())
+	}
+}
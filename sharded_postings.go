@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/dgraph-io/sroar"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// ShardedPostings returns the postings of p whose series belong to shard
+// shardIndex of shardCount, by the hash of their labels.
+func (r *Reader) ShardedPostings(p Postings, shardIndex, shardCount uint64) Postings {
+	if shardIndex >= shardCount {
+		return ErrPostings(errors.Errorf("shard %d out of %d shards", shardIndex, shardCount))
+	}
+	var (
+		out  = make([]storage.SeriesRef, 0, 128)
+		lset labels.Labels
+	)
+	for p.Next() {
+		if err := r.SeriesLabels(p.At(), &lset); err != nil {
+			return ErrPostings(errors.Wrapf(err, "read series %d", p.At()))
+		}
+		// Check if the series belong to the shard.
+		if lset.Hash()%shardCount != shardIndex {
+			continue
+		}
+		out = append(out, p.At())
+	}
+	if err := p.Err(); err != nil {
+		return ErrPostings(errors.Wrap(err, "expand postings"))
+	}
+	return NewListPostings(out)
+}
+
+// PostingsShards holds the series of an index split into shards by the hash
+// of their labels, with a roaring bitmap per shard. Restricting postings to a
+// shard is then a set operation that does not read any series.
+type PostingsShards struct {
+	shards []*sroar.Bitmap
+}
+
+// NewPostingsShards reads all series of r and splits them into shardCount
+// shards, as Reader.ShardedPostings does.
+func NewPostingsShards(r *Reader, shardCount uint64) (*PostingsShards, error) {
+	if shardCount == 0 {
+		return nil, errors.New("no shards")
+	}
+	p, err := r.Postings(AllPostingsKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "get all postings")
+	}
+
+	var (
+		refs = make([][]uint64, shardCount)
+		lset labels.Labels
+	)
+	for p.Next() {
+		if err := r.SeriesLabels(p.At(), &lset); err != nil {
+			return nil, errors.Wrapf(err, "read series %d", p.At())
+		}
+		shard := lset.Hash() % shardCount
+		refs[shard] = append(refs[shard], uint64(p.At()))
+	}
+	if err := p.Err(); err != nil {
+		return nil, errors.Wrap(err, "expand postings")
+	}
+
+	s := &PostingsShards{shards: make([]*sroar.Bitmap, 0, shardCount)}
+	for _, l := range refs {
+		s.shards = append(s.shards, newRoarBitmap(l...))
+	}
+	return s, nil
+}
+
+// ShardedPostings returns the postings of p that belong to shard shardIndex.
+func (s *PostingsShards) ShardedPostings(p Postings, shardIndex uint64) Postings {
+	if shardIndex >= uint64(len(s.shards)) {
+		return ErrPostings(errors.Errorf("shard %d out of %d shards", shardIndex, len(s.shards)))
+	}
+	shard := s.shards[shardIndex]
+	if bs, ok := unreadBitmaps([]Postings{p}); ok {
+		return newBitmapPostings(roaringIntersect(bs[0], shard))
+	}
+
+	out := make([]storage.SeriesRef, 0, 128)
+	for p.Next() {
+		if shard.Contains(uint64(p.At())) {
+			out = append(out, p.At())
+		}
+	}
+	if err := p.Err(); err != nil {
+		return ErrPostings(errors.Wrap(err, "expand postings"))
+	}
+	return NewListPostings(out)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedPostings(t *testing.T) {
+	const shardCount = 4
+
+	rbPath := filepath.Join(t.TempDir(), "index")
+	rewriteIndex(t, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		t.Run(c.codec.Name(), func(t *testing.T) {
+			ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+			require.NoError(t, err)
+			defer ir.Close()
+
+			shards, err := NewPostingsShards(ir, shardCount)
+			require.NoError(t, err)
+
+			for _, ms := range testMatcherSets {
+				p, err := PostingsForMatchers(ir, ms...)
+				require.NoError(t, err)
+				exp, err := ExpandPostings(p)
+				require.NoError(t, err)
+
+				var (
+					all  []storage.SeriesRef
+					lset labels.Labels
+					chks []chunks.Meta
+				)
+				for i := uint64(0); i < shardCount; i++ {
+					p, err := PostingsForMatchers(ir, ms...)
+					require.NoError(t, err)
+					got, err := ExpandPostings(ir.ShardedPostings(p, i, shardCount))
+					require.NoError(t, err)
+					for _, ref := range got {
+						require.NoError(t, ir.Series(ref, &lset, &chks))
+						require.Equal(t, i, lset.Hash()%shardCount)
+					}
+
+					p, err = PostingsForMatchers(ir, ms...)
+					require.NoError(t, err)
+					fromShards, err := ExpandPostings(shards.ShardedPostings(p, i))
+					require.NoError(t, err)
+					require.Equal(t, got, fromShards, "shard %d of %s", i, MatchersKey(ms...))
+
+					all = append(all, got...)
+				}
+				// The shards partition the postings.
+				sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+				require.Equal(t, exp, all)
+			}
+
+			// Shards out of range are errors rather than panics.
+			for _, c := range []struct{ index, count uint64 }{{0, 0}, {shardCount, shardCount}} {
+				p, err := ir.Postings(AllPostingsKey())
+				require.NoError(t, err)
+				_, err = ExpandPostings(ir.ShardedPostings(p, c.index, c.count))
+				require.Error(t, err, "shard %d of %d", c.index, c.count)
+			}
+			p, err := ir.Postings(AllPostingsKey())
+			require.NoError(t, err)
+			_, err = ExpandPostings(shards.ShardedPostings(p, shardCount))
+			require.Error(t, err)
+			_, err = NewPostingsShards(ir, 0)
+			require.Error(t, err)
+		})
+	}
+}
+
+func BenchmarkShardedPostings(b *testing.B) {
+	const shardCount = 16
+
+	rbPath := filepath.Join(b.TempDir(), "index")
+	rewriteIndex(b, bigEndianIndexPath, rbPath, RoaringPostingsCodec)
+
+	ms := []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "__name__", ".+")}
+	for _, c := range []struct {
+		path  string
+		codec PostingsCodec
+	}{
+		{path: bigEndianIndexPath, codec: BigEndianPostingsCodec},
+		{path: rbPath, codec: RoaringPostingsCodec},
+	} {
+		ir, err := NewFileReaderWithOptions(c.path, ReaderOptions{PostingsCodec: c.codec})
+		require.NoError(b, err)
+		defer ir.Close()
+		shards, err := NewPostingsShards(ir, shardCount)
+		require.NoError(b, err)
+
+		b.Run(fmt.Sprintf("%s/hash_series", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p, err := PostingsForMatchers(ir, ms...)
+				require.NoError(b, err)
+				_, err = ExpandPostings(ir.ShardedPostings(p, uint64(i%shardCount), shardCount))
+				require.NoError(b, err)
+			}
+		})
+		b.Run(fmt.Sprintf("%s/shard_bitmap", c.codec.Name()), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p, err := PostingsForMatchers(ir, ms...)
+				require.NoError(b, err)
+				_, err = ExpandPostings(shards.ShardedPostings(p, uint64(i%shardCount)))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
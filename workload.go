@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	h_labels "github.com/Harkishen-Singh/prometheus/model/labels"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// WorkloadQuery is a series selector of a workload.
+//
+// Workloads are text files with one selector per line, optionally followed by
+// weight=<float> and cardinality=<int> to give its share of the workload and
+// the number of series it is expected to match. Empty lines and lines
+// starting with # are ignored:
+//
+//	# Dashboard panels.
+//	go_goroutines{job="prometheus"} weight=4 cardinality=1
+//	{__name__=~"go_.*", job!="prometheus"}
+type WorkloadQuery struct {
+	Selector string
+	// Weight is the share of the query in the workload, 1 if not given.
+	Weight float64
+	// ExpectedCardinality is the number of series the query should match, or
+	// -1 if it is not given.
+	ExpectedCardinality int
+
+	// Matchers of the selector, for the upstream and the forked label packages.
+	Matchers     []*labels.Matcher
+	ForkMatchers []*h_labels.Matcher
+}
+
+// LoadWorkloadFile parses the workload file at path.
+func LoadWorkloadFile(path string) ([]WorkloadQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open workload")
+	}
+	defer f.Close()
+
+	queries, err := ParseWorkload(f)
+	return queries, errors.Wrap(err, path)
+}
+
+// ParseWorkload parses a workload from r.
+func ParseWorkload(r io.Reader) ([]WorkloadQuery, error) {
+	var (
+		queries []WorkloadQuery
+		s       = bufio.NewScanner(r)
+		lineNo  int
+	)
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		q, err := parseWorkloadLine(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNo)
+		}
+		queries = append(queries, q)
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "read workload")
+	}
+	return queries, nil
+}
+
+func parseWorkloadLine(line string) (WorkloadQuery, error) {
+	q := WorkloadQuery{Weight: 1, ExpectedCardinality: -1}
+
+	// Options are peeled off the end of the line, as selectors may contain
+	// spaces themselves. A selector never ends in an option, as it ends
+	// either with a metric name or a closing brace.
+	for {
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			break
+		}
+		opt := line[i+1:]
+		switch {
+		case strings.HasPrefix(opt, "weight="):
+			w, err := strconv.ParseFloat(strings.TrimPrefix(opt, "weight="), 64)
+			if err != nil || w < 0 {
+				return q, errors.Errorf("invalid weight %q", opt)
+			}
+			q.Weight = w
+		case strings.HasPrefix(opt, "cardinality="):
+			c, err := strconv.Atoi(strings.TrimPrefix(opt, "cardinality="))
+			if err != nil || c < 0 {
+				return q, errors.Errorf("invalid cardinality %q", opt)
+			}
+			q.ExpectedCardinality = c
+		default:
+			i = -1
+		}
+		if i < 0 {
+			break
+		}
+		line = strings.TrimSpace(line[:i])
+	}
+
+	ms, err := parser.ParseMetricSelector(line)
+	if err != nil {
+		return q, errors.Wrapf(err, "parse selector %q", line)
+	}
+	q.Selector = line
+	q.Matchers = ms
+	for _, m := range ms {
+		fm, err := h_labels.NewMatcher(h_labels.MatchType(m.Type), m.Name, m.Value)
+		if err != nil {
+			return q, errors.Wrapf(err, "convert matcher %s", m)
+		}
+		q.ForkMatchers = append(q.ForkMatchers, fm)
+	}
+	return q, nil
+}
+
+// weightedMatchers returns the matchers of the queries by their weight.
+func weightedMatchers(queries []WorkloadQuery) []WeightedMatchers {
+	res := make([]WeightedMatchers, 0, len(queries))
+	for _, q := range queries {
+		res = append(res, WeightedMatchers{Matchers: q.Matchers, Weight: q.Weight})
+	}
+	return res
+}
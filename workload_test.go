@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	h_labels "github.com/Harkishen-Singh/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWorkload(t *testing.T) {
+	queries, err := ParseWorkload(strings.NewReader(`
+# Comment.
+go_goroutines{job="prometheus"} weight=4 cardinality=1
+  {job = "demo", instance=~"a b"}	cardinality=15 weight=0.5
+
+up
+{__name__="weight=2"} weight=2
+`))
+	require.NoError(t, err)
+	require.Len(t, queries, 4)
+
+	require.Equal(t, `go_goroutines{job="prometheus"}`, queries[0].Selector)
+	require.Equal(t, 4.0, queries[0].Weight)
+	require.Equal(t, 1, queries[0].ExpectedCardinality)
+	require.Equal(t, []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "job", "prometheus"),
+		labels.MustNewMatcher(labels.MatchEqual, "__name__", "go_goroutines"),
+	}, queries[0].Matchers)
+	require.Equal(t, []*h_labels.Matcher{
+		h_labels.MustNewMatcher(h_labels.MatchEqual, "job", "prometheus"),
+		h_labels.MustNewMatcher(h_labels.MatchEqual, "__name__", "go_goroutines"),
+	}, queries[0].ForkMatchers)
+
+	require.Equal(t, `{job = "demo", instance=~"a b"}`, queries[1].Selector)
+	require.Equal(t, 0.5, queries[1].Weight)
+	require.Equal(t, 15, queries[1].ExpectedCardinality)
+	require.Equal(t, h_labels.MatchRegexp, queries[1].ForkMatchers[1].Type)
+	require.True(t, queries[1].ForkMatchers[1].Matches("a b"))
+
+	require.Equal(t, "up", queries[2].Selector)
+	require.Equal(t, 1.0, queries[2].Weight)
+	require.Equal(t, -1, queries[2].ExpectedCardinality)
+
+	require.Equal(t, `{__name__="weight=2"}`, queries[3].Selector)
+	require.Equal(t, 2.0, queries[3].Weight)
+
+	for _, invalid := range []string{
+		"up weight=-1",
+		"up weight=x",
+		"up cardinality=1.5",
+		"{job=}",
+		"weight=2",
+	} {
+		_, err := ParseWorkload(strings.NewReader(invalid))
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestCompareWorkload(t *testing.T) {
+	be, err := NewFileReader(bigEndianIndexPath)
+	require.NoError(t, err)
+	defer be.Close()
+	rb, err := NewFileReaderWithOptions(roaringBitmapIndexPath, ReaderOptions{PostingsCodec: RoaringPostingsCodec})
+	require.NoError(t, err)
+	defer rb.Close()
+
+	names := []string{"big_endian", "roaring_bitmap"}
+	var buf bytes.Buffer
+	require.NoError(t, CompareWorkload(&buf, loadBenchQueries(t), names, []*Reader{be, rb}, 1))
+	require.Contains(t, buf.String(), `go_gc_duration_seconds{job="demo"}`)
+
+	queries, err := ParseWorkload(strings.NewReader(`{job="demo"} cardinality=3`))
+	require.NoError(t, err)
+	require.Error(t, CompareWorkload(&buf, queries, names, []*Reader{be, rb}, 1))
+}